@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// The admin area, under /admin, lets admins moderate uploads and manage
+// users from the browser. Its routes are only open to admin sessions, not
+// to API tokens.
+
+const (
+	// adminPageSize is how many uploads are listed per page.
+	adminPageSize = 50
+	// adminStatsDays is how many days of uploads are shown in the stats.
+	adminStatsDays = 30
+	// adminTopUploaders is how many of the top uploaders are shown.
+	adminTopUploaders = 10
+)
+
+// byteSize is a size in bytes, printed in binary units.
+type byteSize int64
+
+func (n byteSize) String() string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := int64(n) / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// isAdminSession reports whether the session is of an admin, to show them
+// the link to the admin area.
+func isAdminSession(ctx context.Context) bool {
+	return sessionManager.GetString(ctx, "role") == models.RoleAdmin
+}
+
+// diskUsage returns the total size of the files under dir, or 0 if it
+// doesn't exist.
+func diskUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	return total, err
+}
+
+// renderAdminPage renders a page of the admin area, with the given data
+// besides the one of every page.
+func (a App) renderAdminPage(w http.ResponseWriter, r *http.Request, route, page string, status int, data map[string]any) {
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/"+page)
+	if err != nil {
+		a.Logger.Error("%s: parsing template: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	data["Authenticated"] = sessionManager.GetBool(r.Context(), "authenticated")
+	data["User"] = sessionManager.GetString(r.Context(), "user")
+	data["CSRFToken"] = csrfToken(r.Context())
+	data["Admin"] = isAdminSession(r.Context())
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		a.Logger.Error("%s: executing template: %v", route, err)
+		return
+	}
+}
+
+// adminPage handles GET /admin, which shows the stats of the instance.
+func (a App) adminPage(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.uploadedFiles.Stats(adminStatsDays, adminTopUploaders)
+	if err != nil {
+		a.Logger.Error("GET /admin: getting stats: %v", err)
+		internalServerError(w)
+		return
+	}
+	disk, err := diskUsage(cfg.Storage.UploadedFilesDir)
+	if err != nil {
+		a.Logger.Error("GET /admin: measuring disk usage: %v", err)
+		internalServerError(w)
+		return
+	}
+	users, err := a.users.List()
+	if err != nil {
+		a.Logger.Error("GET /admin: listing users: %v", err)
+		internalServerError(w)
+		return
+	}
+
+	type uploaderRow struct {
+		Uploader string
+		Files    int
+		Bytes    byteSize
+	}
+	var topUploaders []uploaderRow
+	for _, u := range stats.TopUploaders {
+		topUploaders = append(topUploaders, uploaderRow{u.Uploader, u.Files, byteSize(u.Bytes)})
+	}
+	maxPerDay := 0
+	for _, d := range stats.UploadsPerDay {
+		maxPerDay = max(maxPerDay, d.Count)
+	}
+	a.renderAdminPage(w, r, "GET /admin", "admin.tmpl", http.StatusOK, map[string]any{
+		"Files":         stats.Files,
+		"BlobBytes":     byteSize(stats.BlobBytes),
+		"DiskUsage":     byteSize(disk),
+		"LocalStorage":  cfg.Storage.Backend == "local",
+		"Users":         len(users),
+		"Days":          adminStatsDays,
+		"UploadsPerDay": stats.UploadsPerDay,
+		"MaxPerDay":     maxPerDay,
+		"TopUploaders":  topUploaders,
+	})
+}
+
+// adminUploadFilter returns the filter of the uploads listed in the admin
+// area, set in the query parameters "uploader", "type", "since" and "until"
+// (dates, both inclusive), and "min_size" and "max_size" (in KiB).
+func adminUploadFilter(query url.Values) (models.UploadedFileFilter, error) {
+	filter := models.UploadedFileFilter{
+		Uploader:                query.Get("uploader"),
+		Type:                    query.Get("type"),
+		IncludeBurnAfterReading: true,
+		AllVisibilities:         true,
+	}
+	var err error
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.DateOnly, v); err != nil {
+			return filter, fmt.Errorf("invalid date %q", v)
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.DateOnly, v); err != nil {
+			return filter, fmt.Errorf("invalid date %q", v)
+		}
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	for _, p := range []struct {
+		name string
+		size *int64
+	}{{"min_size", &filter.MinSize}, {"max_size", &filter.MaxSize}} {
+		if v := query.Get(p.name); v != "" {
+			kib, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || kib < 0 {
+				return filter, fmt.Errorf("invalid size %q", v)
+			}
+			*p.size = kib << 10
+		}
+	}
+	return filter, nil
+}
+
+// adminUploadsPage handles GET /admin/uploads, which lists every upload,
+// filtered with the query parameters read by adminUploadFilter.
+func (a App) adminUploadsPage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := adminUploadFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	files, total, err := a.uploadedFiles.List(filter, adminPageSize, offset)
+	if err != nil {
+		a.Logger.Error("GET /admin/uploads: listing uploads: %v", err)
+		internalServerError(w)
+		return
+	}
+
+	type uploadRow struct {
+		*models.UploadedFile
+		Size byteSize
+	}
+	rows := make([]uploadRow, len(files))
+	for i, f := range files {
+		rows[i] = uploadRow{f, byteSize(f.Size)}
+	}
+	// pageURL returns the URL of the page of uploads starting at offset,
+	// with the same filter.
+	pageURL := func(offset int) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("offset", strconv.Itoa(offset))
+		return "/admin/uploads?" + q.Encode()
+	}
+	data := map[string]any{
+		"Uploads": rows,
+		"Total":   total,
+		"Query":   query,
+		"Types":   []string{"text", "image", "audio", "video", "application"},
+		// The filter is kept when coming back from deleting uploads.
+		"RawQuery": template.URL(r.URL.RawQuery),
+		"From":     offset + 1,
+		"To":       offset + len(files),
+	}
+	if offset > 0 {
+		data["PrevURL"] = pageURL(max(offset-adminPageSize, 0))
+	}
+	if offset+len(files) < total {
+		data["NextURL"] = pageURL(offset + adminPageSize)
+	}
+	a.renderAdminPage(w, r, "GET /admin/uploads", "admin-uploads.tmpl", http.StatusOK, data)
+}
+
+// adminDeleteUploadsAction handles POST /admin/uploads/delete, which
+// deletes the uploads whose slugs are in the "slug" form field.
+func (a App) adminDeleteUploadsAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		a.Logger.Error("POST /admin/uploads/delete: parsing form: %v", err)
+		internalServerError(w)
+		return
+	}
+	admin := sessionManager.GetString(r.Context(), "user")
+	for _, slug := range r.PostForm["slug"] {
+		f, err := a.uploadedFiles.Get(slug)
+		if errors.Is(err, models.ErrNoRecord) {
+			// Deleted, or expired, in the meantime.
+			continue
+		} else if err != nil {
+			a.Logger.Error("POST /admin/uploads/delete: getting upload %q: %v", slug, err)
+			internalServerError(w)
+			return
+		}
+		if err := a.deleteUpload(r.Context(), f.ID); err != nil && !errors.Is(err, models.ErrNoRecord) {
+			a.Logger.Error("POST /admin/uploads/delete: deleting upload %q: %v", slug, err)
+			internalServerError(w)
+			return
+		}
+		a.Logger.Info("Admin %q deleted upload %q of user %q.", admin, f.Slug, f.Uploader)
+	}
+	sendTo(w, "/admin/uploads?"+r.URL.RawQuery)
+}
+
+// adminUsersPage handles GET /admin/users, where admins manage users.
+func (a App) adminUsersPage(w http.ResponseWriter, r *http.Request) {
+	a.renderAdminUsersPage(w, r, "GET /admin/users", http.StatusOK, map[string]any{})
+}
+
+// renderAdminUsersPage renders the list of users, with the given data.
+func (a App) renderAdminUsersPage(w http.ResponseWriter, r *http.Request, route string, status int, data map[string]any) {
+	users, err := a.users.List()
+	if err != nil {
+		a.Logger.Error("%s: listing users: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	data["Users"] = users
+	data["Roles"] = models.Roles
+	data["DefaultRole"] = models.RoleUploader
+	a.renderAdminPage(w, r, route, "admin-users.tmpl", status, data)
+}
+
+// newPassword generates a random password for a user created or reset by an
+// admin, to be given to them.
+func newPassword() (string, error) {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating password: %v", err)
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b)), nil
+}
+
+// adminCreateUserAction handles POST /admin/users, creating a user with a
+// random password, which is shown this one time.
+func (a App) adminCreateUserAction(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	role := r.PostFormValue("role")
+	if username == "" || !slices.Contains(models.Roles, role) {
+		http.Error(w, "A user needs a username and a valid role", http.StatusBadRequest)
+		return
+	}
+	password, err := newPassword()
+	if err != nil {
+		a.Logger.Error("POST /admin/users: %v", err)
+		internalServerError(w)
+		return
+	}
+	_, err = a.users.Insert(username, password, role)
+	if errors.Is(err, models.ErrDuplicateUsername) {
+		a.renderAdminUsersPage(w, r, "POST /admin/users", http.StatusConflict, map[string]any{"DuplicateUsername": username})
+		return
+	} else if err != nil {
+		a.Logger.Error("POST /admin/users: adding user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+	a.Logger.Info("Admin %q created user %q with the %s role.", sessionManager.GetString(r.Context(), "user"), username, role)
+	a.renderAdminUsersPage(w, r, "POST /admin/users", http.StatusOK, map[string]any{"NewPassword": password, "PasswordOf": username})
+}
+
+// adminResetPasswordAction handles POST /admin/users/{username}/password,
+// giving a user a new random password, which is shown this one time. The
+// user is logged out everywhere.
+func (a App) adminResetPasswordAction(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	route := "POST /admin/users/" + username + "/password"
+	password, err := newPassword()
+	if err != nil {
+		a.Logger.Error("%s: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	err = a.users.SetPassword(username, password)
+	if errors.Is(err, models.ErrNoRecord) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		a.Logger.Error("%s: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	if err := a.logOutOtherSessions(r, username); err != nil {
+		a.Logger.Error("%s: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	a.Logger.Info("Admin %q reset the password of user %q.", sessionManager.GetString(r.Context(), "user"), username)
+	a.renderAdminUsersPage(w, r, route, http.StatusOK, map[string]any{"NewPassword": password, "PasswordOf": username})
+}
+
+// adminDisableUserAction handles POST /admin/users/{username}/disable,
+// which also logs the user out everywhere. Admins can't disable themselves.
+func (a App) adminDisableUserAction(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, true)
+}
+
+// adminEnableUserAction handles POST /admin/users/{username}/enable.
+func (a App) adminEnableUserAction(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, false)
+}
+
+func (a App) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	username := chi.URLParam(r, "username")
+	admin := sessionManager.GetString(r.Context(), "user")
+	action := "enable"
+	if disabled {
+		action = "disable"
+	}
+	route := "POST /admin/users/" + username + "/" + action
+	if disabled && username == admin {
+		http.Error(w, "You can't disable yourself", http.StatusBadRequest)
+		return
+	}
+	err := a.users.SetDisabled(username, disabled)
+	if errors.Is(err, models.ErrNoRecord) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		a.Logger.Error("%s: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	if disabled {
+		if err := a.logOutOtherSessions(r, username); err != nil {
+			a.Logger.Error("%s: %v", route, err)
+			internalServerError(w)
+			return
+		}
+	}
+	a.Logger.Info("Admin %q %sd user %q.", admin, action, username)
+	sendTo(w, "/admin/users")
+}
+
+// logOutOtherSessions revokes every session of a user, but the one of the
+// request.
+func (a App) logOutOtherSessions(r *http.Request, username string) error {
+	current := sessionID(sessionManager.Token(r.Context()))
+	_, err := revokeSessions(a.sessions, username, func(id string) bool { return id != current })
+	if err != nil {
+		return fmt.Errorf("logging out user %q: %v", username, err)
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// Limits on the number of uploads returned by one page of GET /api/v1/uploads.
+const (
+	apiDefaultPageSize = 20
+	apiMaxPageSize     = 100
+)
+
+// apiUpload is the JSON representation of an uploaded file.
+type apiUpload struct {
+	ID               string     `json:"id"`
+	Title            string     `json:"title"`
+	Uploader         string     `json:"uploader"`
+	Filename         string     `json:"filename"`
+	MIMEType         string     `json:"mime_type"`
+	Size             int64      `json:"size"`
+	Created          time.Time  `json:"created_at"`
+	Expires          *time.Time `json:"expires_at"`
+	BurnAfterReading bool       `json:"burn_after_reading"`
+	Language         string     `json:"language,omitempty"`
+	Visibility       string     `json:"visibility"`
+	URL              string     `json:"url"`
+	RawURL           string     `json:"raw_url"`
+}
+
+func newAPIUpload(f *models.UploadedFile) apiUpload {
+	u := apiUpload{
+		ID:               f.Slug,
+		Title:            f.Title,
+		Uploader:         f.Uploader,
+		Filename:         f.Filename,
+		MIMEType:         f.MIMEType,
+		Size:             f.Size,
+		Created:          f.Created,
+		BurnAfterReading: f.BurnAfterReading,
+		Language:         f.Language,
+		Visibility:       f.Visibility,
+		URL:              absoluteURL(f.FileHref()),
+		RawURL:           rawFileURL(f),
+	}
+	if !f.Expires.IsZero() {
+		u.Expires = &f.Expires
+	}
+	return u
+}
+
+const invalidVisibilityMessage = `"visibility" must be one of "public", "unlisted" or "private".`
+
+// apiError is the JSON body of error responses.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (a App) apiRouter() chi.Router {
+	r := chi.NewRouter()
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "No such endpoint.")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed.")
+	})
+
+	r.With(apiRequireLogin, requireScope(models.ScopeUpload), a.requireRole(models.RoleUploader), a.verifyCSRF, limitUploadSize).Post("/texts", a.apiCreateText)
+	r.With(apiRequireLogin, requireScope(models.ScopeUpload), a.requireRole(models.RoleUploader), a.verifyCSRF, limitUploadSize).Post("/files", a.apiCreateFile)
+	r.With(requireScope(models.ScopeRead)).Get("/uploads", a.apiListUploads)
+	r.With(requireScope(models.ScopeRead)).Get("/uploads/{slug}", a.apiGetUpload)
+	r.With(apiRequireLogin, requireScope(models.ScopeUpload), a.verifyCSRF).Patch("/uploads/{slug}", a.apiUpdateUpload)
+	r.With(apiRequireLogin, requireScope(models.ScopeDelete), a.verifyCSRF).Delete("/uploads/{slug}", a.apiDeleteUpload)
+
+	return r
+}
+
+func apiRequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loggedIn(r) {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "You must be logged in to perform this action.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiCreateText handles POST /api/v1/texts.
+func (a App) apiCreateText(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Title            string `json:"title"`
+		Text             string `json:"text"`
+		Expires          string `json:"expires"`
+		BurnAfterReading bool   `json:"burn_after_reading"`
+		Language         string `json:"language"`
+		Visibility       string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		uploadError(w, r, fmt.Errorf("%w: invalid JSON body: %w", errBadUpload, err))
+		return
+	}
+	if req.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_text", `"text" must not be empty.`)
+		return
+	}
+	expires, err := parseExpiry(req.Expires)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_expires", `"expires" must be one of "never", "1h", "1d" or "1w".`)
+		return
+	}
+	language, err := parseLanguage(req.Language)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_language", fmt.Sprintf("Unknown language %q.", req.Language))
+		return
+	}
+	visibility, err := parseVisibility(req.Visibility)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_visibility", invalidVisibilityMessage)
+		return
+	}
+
+	f := &models.UploadedFile{
+		Title:            req.Title,
+		Uploader:         currentUser(r),
+		Expires:          expires,
+		BurnAfterReading: req.BurnAfterReading,
+		Language:         language,
+		Visibility:       visibility,
+	}
+	if err := a.saveText(r.Context(), f, req.Text); err != nil {
+		a.Logger.Error("POST /api/v1/texts: %v", err)
+		uploadError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIUpload(f))
+}
+
+// apiCreateFile handles POST /api/v1/files, a multipart form with the file
+// in the "file" part and the other options in the "title", "expires",
+// "burn_after_reading" and "visibility" parts.
+func (a App) apiCreateFile(w http.ResponseWriter, r *http.Request) {
+	form, err := a.readUploadForm(r, "file")
+	if err != nil {
+		a.Logger.Error("POST /api/v1/files: %v", err)
+		uploadError(w, r, err)
+		return
+	}
+	expires, err := parseExpiry(form.Values.Get("expires"))
+	if err != nil {
+		a.discardBlob(r.Context(), form.blob)
+		writeAPIError(w, http.StatusBadRequest, "invalid_expires", `"expires" must be one of "never", "1h", "1d" or "1w".`)
+		return
+	}
+	visibility, err := parseVisibility(form.Values.Get("visibility"))
+	if err != nil {
+		a.discardBlob(r.Context(), form.blob)
+		writeAPIError(w, http.StatusBadRequest, "invalid_visibility", invalidVisibilityMessage)
+		return
+	}
+	burn, _ := strconv.ParseBool(form.Values.Get("burn_after_reading"))
+
+	title := form.Values.Get("title")
+	if title == "" {
+		title = form.Filename
+	}
+	f := &models.UploadedFile{
+		Title:            title,
+		Uploader:         currentUser(r),
+		Filename:         form.Filename,
+		Expires:          expires,
+		BurnAfterReading: burn,
+		Visibility:       visibility,
+	}
+	if err := a.commitUpload(r.Context(), f, form.blob); err != nil {
+		a.Logger.Error("POST /api/v1/files: %v", err)
+		uploadError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIUpload(f))
+}
+
+// apiListUploads handles GET /api/v1/uploads. The page of uploads is chosen
+// with the "limit" and "offset" query parameters, and the uploads of a
+// single user with "uploader". Only public uploads are listed, and those of
+// the user making the request.
+func (a App) apiListUploads(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", apiDefaultPageSize)
+	if err != nil || limit < 1 || limit > apiMaxPageSize {
+		writeAPIError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf(`"limit" must be between 1 and %d.`, apiMaxPageSize))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_offset", `"offset" must be a non-negative integer.`)
+		return
+	}
+
+	filter := models.UploadedFileFilter{
+		Uploader: r.URL.Query().Get("uploader"),
+		Viewer:   currentUser(r),
+	}
+	files, total, err := a.uploadedFiles.List(filter, limit, offset)
+	if err != nil {
+		a.Logger.Error("GET /api/v1/uploads: %v", err)
+		apiInternalServerError(w)
+		return
+	}
+
+	uploads := []apiUpload{}
+	for _, f := range files {
+		uploads = append(uploads, newAPIUpload(f))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uploads": uploads,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// apiGetUpload handles GET /api/v1/uploads/{slug}.
+func (a App) apiGetUpload(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.apiUploadFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIUpload(f))
+}
+
+// apiUpdateUpload handles PATCH /api/v1/uploads/{slug}, which changes the
+// title of an upload.
+func (a App) apiUpdateUpload(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.apiUploadFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !a.apiCheckCanModify(w, r, f, "edit") {
+		return
+	}
+	var req struct {
+		Title *string `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("Invalid JSON body: %v.", err))
+		return
+	}
+	if req.Title == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_title", `"title" is required.`)
+		return
+	}
+	f.Title = strings.TrimSpace(*req.Title)
+	if err := a.uploadedFiles.UpdateTitle(f.ID, f.Title); errors.Is(err, models.ErrNoRecord) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Upload not found.")
+		return
+	} else if err != nil {
+		a.Logger.Error("PATCH /api/v1/uploads/: %v", err)
+		apiInternalServerError(w)
+		return
+	}
+	if f.Uploader != currentUser(r) {
+		a.Logger.Info("Admin %q renamed upload %q of user %q.", currentUser(r), f.Slug, f.Uploader)
+	}
+	writeJSON(w, http.StatusOK, newAPIUpload(f))
+}
+
+// apiDeleteUpload handles DELETE /api/v1/uploads/{slug}, which also deletes
+// its blob from storage unless another upload has the same contents.
+func (a App) apiDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.apiUploadFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !a.apiCheckCanModify(w, r, f, "delete") {
+		return
+	}
+	if err := a.deleteUpload(r.Context(), f.ID); errors.Is(err, models.ErrNoRecord) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Upload not found.")
+		return
+	} else if err != nil {
+		a.Logger.Error("DELETE /api/v1/uploads/: %v", err)
+		apiInternalServerError(w)
+		return
+	}
+	if f.Uploader != currentUser(r) {
+		a.Logger.Info("Admin %q deleted upload %q of user %q.", currentUser(r), f.Slug, f.Uploader)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiCheckCanModify checks that the user making the request may edit or
+// delete an upload, i.e. that they're its uploader or an admin. If not, an
+// error response is written and false is returned.
+func (a App) apiCheckCanModify(w http.ResponseWriter, r *http.Request, f *models.UploadedFile, action string) bool {
+	ok, err := a.canModify(r, f)
+	if err != nil {
+		a.Logger.Error("%s %s: getting role of user %q: %v", r.Method, r.URL.Path, currentUser(r), err)
+		apiInternalServerError(w)
+		return false
+	}
+	if !ok {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Only the uploader or an admin can "+action+" this upload.")
+		return false
+	}
+	return true
+}
+
+// apiUploadFromURL returns the uploaded file named by the slug in the URL,
+// if the user making the request may see it. If ok is false, an error
+// response has already been written.
+func (a App) apiUploadFromURL(w http.ResponseWriter, r *http.Request) (f *models.UploadedFile, ok bool) {
+	f, err := a.uploadedFiles.Get(chi.URLParam(r, "slug"))
+	if errors.Is(err, models.ErrNoRecord) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Upload not found.")
+		return nil, false
+	} else if err != nil {
+		a.Logger.Error("%s %s: %v", r.Method, r.URL.Path, err)
+		apiInternalServerError(w)
+		return nil, false
+	}
+	if !canView(r, f) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Upload not found.")
+		return nil, false
+	}
+	return f, true
+}
+
+// queryInt returns the integer value of a query parameter, or def if it's
+// unset.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// isAPIRequest reports whether the request is to the JSON API, and so should
+// get JSON error responses.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{apiErrorDetail{Status: status, Code: code, Message: message}})
+}
+
+func apiInternalServerError(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusInternalServerError, "internal", "Internal server error.")
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsilvap/hermes/internal/metadata"
+	"github.com/tsilvap/hermes/internal/models"
+	"github.com/tsilvap/hermes/internal/storage"
+)
+
+// Uploaded file contents are stored as blobs named by their SHA-256 digest,
+// so that identical uploads share the same blob. The uploaded_files rows
+// referencing a blob are counted in the blobs table.
+//
+// blobMu serializes linking new uploads to blobs with removing blobs that
+// are no longer referenced, so that a blob isn't deleted right after an
+// upload found it already stored.
+var blobMu sync.Mutex
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// headWriter keeps the first sniffLen bytes written to it, from which the
+// media type of a file is detected.
+type headWriter struct {
+	head []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := sniffLen - len(w.head); n > 0 {
+		w.head = append(w.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// saveUpload stores the contents of r as the blob of f and inserts f in the
+// database. size is the number of bytes r will yield, or -1 if unknown.
+func (a App) saveUpload(ctx context.Context, f *models.UploadedFile, r io.Reader, size int64) error {
+	blob, err := a.stageBlob(ctx, r, size)
+	if err != nil {
+		return err
+	}
+	return a.commitUpload(ctx, f, blob)
+}
+
+// stagedBlob is the content of an upload, stored under a temporary name until
+// it's committed.
+type stagedBlob struct {
+	tmpName string
+	digest  string
+	size    int64
+	// head is the first sniffLen bytes of the blob.
+	head []byte
+}
+
+// stageBlob stores the contents of r under a temporary name. It must then be
+// either committed with commitUpload or discarded with discardBlob.
+func (a App) stageBlob(ctx context.Context, r io.Reader, size int64) (*stagedBlob, error) {
+	tmpID, err := randomIdentifier(16)
+	if err != nil {
+		return nil, fmt.Errorf("generating temporary name: %v", err)
+	}
+	tmpName := path.Join("tmp", tmpID)
+
+	h := sha256.New()
+	counter := &countingWriter{}
+	head := &headWriter{}
+	if err := a.storage.Put(ctx, tmpName, io.TeeReader(r, io.MultiWriter(h, counter, head)), size); err != nil {
+		a.storage.Delete(ctx, tmpName)
+		return nil, fmt.Errorf("storing file: %w", err)
+	}
+	return &stagedBlob{tmpName: tmpName, digest: hex.EncodeToString(h.Sum(nil)), size: counter.n, head: head.head}, nil
+}
+
+// discardBlob deletes a staged blob that won't be committed.
+func (a App) discardBlob(ctx context.Context, blob *stagedBlob) {
+	if err := a.storage.Delete(ctx, blob.tmpName); err != nil {
+		a.Logger.Warn("deleting temporary file %q: %v", blob.tmpName, err)
+	}
+}
+
+// commitUpload moves a staged blob to its content-addressed name, unless
+// it's already stored, and inserts f in the database with it. Files whose
+// contents don't match their extension are rejected.
+func (a App) commitUpload(ctx context.Context, f *models.UploadedFile, blob *stagedBlob) error {
+	var err error
+	if f.MIMEType, err = detectMIMEType(f.Filename, blob.head); err != nil {
+		a.discardBlob(ctx, blob)
+		return fmt.Errorf("%w (detected %s)", err, f.MIMEType)
+	}
+	if f.Slug == "" {
+		if f.Slug, err = generateSlug(); err != nil {
+			a.discardBlob(ctx, blob)
+			return fmt.Errorf("generating slug: %v", err)
+		}
+	}
+	if !cfg.Storage.KeepImageMetadata {
+		if blob, err = a.stripMetadata(ctx, f, blob); err != nil {
+			return err
+		}
+	}
+	f.Digest = blob.digest
+	f.Size = blob.size
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	_, err = a.storage.Stat(ctx, f.Digest)
+	switch {
+	case err == nil:
+		// Already stored by a previous upload.
+		a.discardBlob(ctx, blob)
+	case errors.Is(err, storage.ErrNotExist):
+		if err := a.storage.Rename(ctx, blob.tmpName, f.Digest); err != nil {
+			a.discardBlob(ctx, blob)
+			return fmt.Errorf("storing file: %v", err)
+		}
+	default:
+		a.discardBlob(ctx, blob)
+		return fmt.Errorf("checking for stored file: %v", err)
+	}
+
+	if err := a.uploadedFiles.Insert(f); err != nil {
+		return fmt.Errorf("inserting uploaded file: %v", err)
+	}
+	return nil
+}
+
+// stripMetadata strips the metadata of a staged image, recording what was
+// removed in f. It returns the staged blob of the stripped image, which is
+// blob itself if there was nothing to strip. blob is discarded on error.
+func (a App) stripMetadata(ctx context.Context, f *models.UploadedFile, blob *stagedBlob) (*stagedBlob, error) {
+	rc, err := a.storage.Open(ctx, blob.tmpName)
+	if err != nil {
+		a.discardBlob(ctx, blob)
+		return nil, fmt.Errorf("opening staged file: %v", err)
+	}
+	defer rc.Close()
+	img, err := metadata.Parse(rc)
+	if metadata.IsMalformed(err) {
+		a.discardBlob(ctx, blob)
+		return nil, fmt.Errorf("%w: %v", errBadUpload, err)
+	} else if err != nil {
+		a.discardBlob(ctx, blob)
+		return nil, fmt.Errorf("reading staged file: %v", err)
+	}
+	if len(img.Removed) == 0 {
+		return blob, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := img.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	stripped, err := a.stageBlob(ctx, pr, -1)
+	pr.Close()
+	a.discardBlob(ctx, blob)
+	if err != nil {
+		return nil, fmt.Errorf("stripping metadata: %w", err)
+	}
+	f.StrippedMetadata = img.Removed
+	return stripped, nil
+}
+
+// saveText saves an uploaded text under a generated filename, which is also
+// its title if f has none. Its language is guessed if f has none. Markdown
+// texts get a .md extension, so that they're rendered.
+func (a App) saveText(ctx context.Context, f *models.UploadedFile, text string) error {
+	if f.Language == "" {
+		f.Language = guessLanguage("", text)
+	}
+	ext := ".txt"
+	if f.Language == markdownLanguage {
+		ext = ".md"
+	}
+	filename, err := generateTextFileName(ext)
+	if err != nil {
+		return fmt.Errorf("generating filename: %v", err)
+	}
+	f.Filename = filename
+	if f.Title == "" {
+		f.Title = filename
+	}
+	return a.saveUpload(ctx, f, strings.NewReader(text), int64(len(text)))
+}
+
+// deleteUpload deletes an uploaded file, and its blob if no other file
+// references it.
+func (a App) deleteUpload(ctx context.Context, id int) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	orphan, err := a.uploadedFiles.Delete(id)
+	if err != nil {
+		return err
+	}
+	if orphan != "" {
+		if err := a.storage.Delete(ctx, orphan); err != nil {
+			return fmt.Errorf("deleting blob %s: %v", orphan, err)
+		}
+		a.deleteThumbnails(ctx, orphan)
+	}
+	return nil
+}
+
+// reapExpiredUploads periodically deletes expired uploaded files and their
+// blobs. It never returns.
+func (a App) reapExpiredUploads(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.deleteExpiredUploads(context.Background()); err != nil {
+			a.Logger.Error("deleting expired uploads: %v", err)
+		}
+		if err := a.deleteExpiredTusUploads(); err != nil {
+			a.Logger.Error("deleting expired tus uploads: %v", err)
+		}
+	}
+}
+
+func (a App) deleteExpiredUploads(ctx context.Context) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	n, orphans, err := a.uploadedFiles.DeleteExpired()
+	if err != nil {
+		return err
+	}
+	for _, digest := range orphans {
+		if err := a.storage.Delete(ctx, digest); err != nil {
+			a.Logger.Error("deleting blob %s: %v", digest, err)
+		}
+		a.deleteThumbnails(ctx, digest)
+	}
+	if n > 0 {
+		a.Logger.Info("Deleted %d expired uploads.", n)
+	}
+	return nil
+}
+
+// openUpload opens the contents of an uploaded file. Files to be burned after
+// reading are deleted before they're returned, so that only one caller can
+// ever open them; other callers get an error matching storage.ErrNotExist.
+func (a App) openUpload(ctx context.Context, f *models.UploadedFile) (io.ReadSeekCloser, error) {
+	if !f.BurnAfterReading {
+		return a.storage.Open(ctx, f.Digest)
+	}
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	orphan, err := a.uploadedFiles.Delete(f.ID)
+	if errors.Is(err, models.ErrNoRecord) {
+		return nil, fmt.Errorf("%w: upload %s was already read", storage.ErrNotExist, f.Slug)
+	} else if err != nil {
+		return nil, err
+	}
+	if orphan == "" {
+		// Other uploads share the blob, so leave it in place.
+		return a.storage.Open(ctx, f.Digest)
+	}
+
+	// Move the blob out of the way while it's being read, so that an upload
+	// with the same contents doesn't reuse it in the meantime.
+	tmpID, err := randomIdentifier(16)
+	if err != nil {
+		return nil, fmt.Errorf("generating temporary name: %v", err)
+	}
+	tmpName := path.Join("tmp", tmpID)
+	if err := a.storage.Rename(ctx, orphan, tmpName); err != nil {
+		return nil, fmt.Errorf("moving blob %s: %v", orphan, err)
+	}
+	a.deleteThumbnails(ctx, orphan)
+	rc, err := a.storage.Open(ctx, tmpName)
+	if err != nil {
+		a.storage.Delete(ctx, tmpName)
+		return nil, err
+	}
+	return &burnedBlob{rc, func() {
+		if err := a.storage.Delete(context.Background(), tmpName); err != nil {
+			a.Logger.Error("deleting burned blob %q: %v", tmpName, err)
+		}
+	}}, nil
+}
+
+// burnedBlob is a blob that is deleted once closed.
+type burnedBlob struct {
+	io.ReadSeekCloser
+	deleteBlob func()
+}
+
+func (b *burnedBlob) Close() error {
+	err := b.ReadSeekCloser.Close()
+	b.deleteBlob()
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// Requests changing state on behalf of a browser session must carry the
+// session's CSRF token, either in the csrf_token form field or in the
+// X-CSRF-Token header, so that other sites can't make them. Requests
+// authenticated with an API token don't need one, since browsers don't send
+// those by themselves. That's also why HTTP basic auth isn't accepted: once
+// entered in the browser, its credentials are sent along with any request.
+const (
+	csrfTokenKey    = "csrf_token"
+	csrfTokenHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token of the session, creating it for logged in
+// users if needed. Every form in a page must include it in a csrf_token
+// field, which must be the first field of multipart forms.
+//
+// Anonymous visitors only need a token to log in, so they're only given one
+// (and with it, a session) by the login page.
+func csrfToken(ctx context.Context) string {
+	token := sessionManager.GetString(ctx, csrfTokenKey)
+	if token == "" && sessionManager.GetBool(ctx, "authenticated") {
+		token = newCSRFToken(ctx)
+	}
+	return token
+}
+
+// newCSRFToken gives the session a new CSRF token, and returns it.
+func newCSRFToken(ctx context.Context) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		// The system's random number generator is broken.
+		panic(fmt.Sprintf("generating CSRF token: %v", err))
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	sessionManager.Put(ctx, csrfTokenKey, token)
+	return token
+}
+
+// verifyCSRF rejects unsafe requests that don't carry the CSRF token of
+// their session. It must come after the middlewares authenticating the
+// request.
+func (a App) verifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if requestToken(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		got, err := requestCSRFToken(r)
+		if err != nil {
+			a.Logger.Warn("%s %s: reading CSRF token: %v", r.Method, r.URL.Path, err)
+		}
+		want := sessionManager.GetString(r.Context(), csrfTokenKey)
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			a.Logger.Warn("%s %s: invalid CSRF token", r.Method, r.URL.Path)
+			if isAPIRequest(r) {
+				writeAPIError(w, http.StatusForbidden, "invalid_csrf_token", "Missing or invalid CSRF token.")
+			} else {
+				forbidden(w, "Missing or invalid CSRF token. Reload the page and try again.")
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestCSRFToken returns the CSRF token sent with a request.
+func requestCSRFToken(r *http.Request) (string, error) {
+	if token := r.Header.Get(csrfTokenHeader); token != "" {
+		return token, nil
+	}
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return r.PostFormValue(csrfTokenKey), nil
+	case "multipart/form-data":
+		return peekMultipartField(r, params["boundary"], csrfTokenKey)
+	}
+	return "", nil
+}
+
+// peekMultipartField returns the value of the first part of a multipart
+// form if it's the named field, without consuming the request body, so
+// that uploads can still be streamed by readUploadForm.
+func peekMultipartField(r *http.Request, boundary, name string) (string, error) {
+	var peeked bytes.Buffer
+	body := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&peeked, body), body}
+	}()
+
+	// Everything read from the body is kept, to be read again, so only
+	// read as much of it as a form field may take.
+	limit := io.LimitReader(body, maxFormFieldSize+int64(len(boundary))+1024)
+	mr := multipart.NewReader(io.TeeReader(limit, &peeked), boundary)
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", err
+	}
+	if part.FormName() != name {
+		return "", nil
+	}
+	var value strings.Builder
+	if _, err := io.Copy(&value, part); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
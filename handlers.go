@@ -1,24 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
-	"database/sql"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"math/big"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
-
-	"golang.org/x/crypto/argon2"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/tsilvap/hermes/internal/models"
+	"github.com/tsilvap/hermes/internal/storage"
 )
 
 func (a App) index(w http.ResponseWriter, r *http.Request) {
@@ -34,11 +32,24 @@ func (a App) index(w http.ResponseWriter, r *http.Request) {
 		internalServerError(w)
 		return
 	}
+	// Anonymous visitors are shown the upload buttons too, which take them
+	// to the login page.
+	canUpload := true
+	if sessionManager.GetBool(r.Context(), "authenticated") {
+		if canUpload, err = a.hasRole(r, models.RoleUploader); err != nil {
+			a.Logger.Error("GET /: getting role of user: %v", err)
+			internalServerError(w)
+			return
+		}
+	}
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
 
 		"LatestUploads": latestUploads,
+		"CanUpload":     canUpload,
 	})
 	if err != nil {
 		a.Logger.Error("GET /: executing template: %v", err)
@@ -52,19 +63,11 @@ func (a App) loginPage(w http.ResponseWriter, r *http.Request) {
 		sendTo(w, "/")
 		return
 	}
-
-	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/login.tmpl")
-	if err != nil {
-		a.Logger.Error("GET /login: parsing template: %v", err)
-		internalServerError(w)
-		return
-	}
-	err = tmpl.Execute(w, nil)
-	if err != nil {
-		a.Logger.Error("GET /login: executing template: %v", err)
-		internalServerError(w)
-		return
+	if csrfToken(r.Context()) == "" {
+		newCSRFToken(r.Context())
+		sessionManager.SetDeadline(r.Context(), time.Now().Add(anonymousSessionLifetime))
 	}
+	a.renderLoginPage(w, r, "GET /login", http.StatusOK, nil)
 }
 
 func (a App) loginAction(w http.ResponseWriter, r *http.Request) {
@@ -75,31 +78,54 @@ func (a App) loginAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !r.PostForm.Has("username") || !r.PostForm.Has("password") {
-		// TODO: Handle missing fields.
-		fmt.Printf("%#v\n", r.PostForm)
-		internalServerError(w) // Will be changed to BadRequest.
+		a.Logger.Error("POST /login: missing username or password")
+		http.Error(w, "Missing username or password", http.StatusBadRequest)
 		return
 	}
-	if err := authenticateUser(r, r.PostForm.Get("username"), r.PostForm.Get("password")); err != nil {
+	totpNeeded, err := a.authenticateUser(r, r.PostForm.Get("username"), r.PostForm.Get("password"))
+	if err != nil {
 		a.Logger.Error("POST /login: authenticating user %q: %v", r.PostForm.Get("username"), err)
-
-		tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/login.tmpl")
-		if err != nil {
-			a.Logger.Error("POST /login: parsing template: %v", err)
-			internalServerError(w)
+		var tooMany *tooManyLoginsError
+		if errors.As(err, &tooMany) {
+			w.Header().Set("Retry-After", retryAfter(tooMany))
+			a.renderLoginPage(w, r, "POST /login", http.StatusTooManyRequests, map[string]any{"TooManyLogins": true})
 			return
 		}
-		err = tmpl.Execute(w, map[string]any{"BadLogin": true})
-		if err != nil {
-			a.Logger.Error("POST /login: executing template: %v", err)
-			internalServerError(w)
+		if errors.Is(err, models.ErrUserDisabled) {
+			a.renderLoginPage(w, r, "POST /login", http.StatusOK, map[string]any{"Disabled": true})
 			return
 		}
+		a.renderLoginPage(w, r, "POST /login", http.StatusOK, map[string]any{"BadLogin": true})
+		return
+	}
+	if totpNeeded {
+		sendTo(w, "/login/totp")
 		return
 	}
 	sendTo(w, "/")
 }
 
+// renderLoginPage renders either step of the login page, with the given
+// data besides the CSRF token.
+func (a App) renderLoginPage(w http.ResponseWriter, r *http.Request, route string, status int, data map[string]any) {
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/login.tmpl")
+	if err != nil {
+		a.Logger.Error("%s: parsing template: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["CSRFToken"] = csrfToken(r.Context())
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		a.Logger.Error("%s: executing template: %v", route, err)
+		return
+	}
+}
+
 func (a App) logoutAction(w http.ResponseWriter, r *http.Request) {
 	if err := sessionManager.Destroy(r.Context()); err != nil {
 		a.Logger.Error("POST /logout: clearing session data: %v", err)
@@ -110,7 +136,7 @@ func (a App) logoutAction(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a App) uploadTextPage(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/text.tmpl")
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/text.tmpl", "templates/upload-options.tmpl")
 	if err != nil {
 		a.Logger.Error("GET /text: parsing template: %v", err)
 		internalServerError(w)
@@ -119,6 +145,10 @@ func (a App) uploadTextPage(w http.ResponseWriter, r *http.Request) {
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
+
+		"Languages": languages(),
 	})
 	if err != nil {
 		a.Logger.Error("GET /text: executing template: %v", err)
@@ -131,36 +161,44 @@ func (a App) uploadTextAction(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		a.Logger.Error("POST /text: parsing form: %v", err)
-		internalServerError(w)
+		uploadError(w, r, fmt.Errorf("%w: %w", errBadUpload, err))
 		return
 	}
 	if !r.PostForm.Has("input") {
-		// TODO: Handle no text input.
-		fmt.Printf("%#v\n", r.PostForm)
-		internalServerError(w) // Will be changed to BadRequest.
+		a.Logger.Error("POST /text: missing text")
+		http.Error(w, "Missing text", http.StatusBadRequest)
 		return
 	}
-	filename, err := generateTextFileName()
+	expires, err := parseExpiry(r.PostForm.Get("expires"))
 	if err != nil {
-		a.Logger.Error("POST /text: generating title: %v", err)
-		internalServerError(w)
+		a.Logger.Error("POST /text: %v", err)
+		http.Error(w, "Invalid expiration", http.StatusBadRequest)
 		return
 	}
-	err = os.WriteFile(filepath.Join(cfg.Storage.UploadedFilesDir, filename), []byte(r.PostForm.Get("input")), 0600)
+	language, err := parseLanguage(r.PostForm.Get("language"))
 	if err != nil {
-		a.Logger.Error("POST /text: writing file: %v", err)
-		internalServerError(w)
+		a.Logger.Error("POST /text: %v", err)
+		http.Error(w, "Invalid language", http.StatusBadRequest)
 		return
 	}
-
-	title := r.PostForm.Get("title")
-	if title == "" {
-		title = filename
+	visibility, err := parseVisibility(r.PostForm.Get("visibility"))
+	if err != nil {
+		a.Logger.Error("POST /text: %v", err)
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	f := &models.UploadedFile{
+		Title:            r.PostForm.Get("title"),
+		Uploader:         currentUser(r),
+		Expires:          expires,
+		BurnAfterReading: r.PostForm.Has("burn"),
+		Language:         language,
+		Visibility:       visibility,
 	}
-	id, err := a.uploadedFiles.Insert(title, sessionManager.GetString(r.Context(), "user"), filename)
+	err = a.saveText(r.Context(), f, r.PostForm.Get("input"))
 	if err != nil {
 		a.Logger.Error("POST /text: %v", err)
-		internalServerError(w)
+		uploadError(w, r, err)
 		return
 	}
 
@@ -173,8 +211,10 @@ func (a App) uploadTextAction(w http.ResponseWriter, r *http.Request) {
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
 
-		"Link": fmt.Sprintf("%s://%s/t/%d", cfg.HTTP.Schema, cfg.HTTP.DomainName, id),
+		"Link": fmt.Sprintf("%s://%s/t/%s", cfg.HTTP.Schema, cfg.HTTP.DomainName, f.Slug),
 	})
 	if err != nil {
 		a.Logger.Error("POST /text: executing template: %v", err)
@@ -184,7 +224,7 @@ func (a App) uploadTextAction(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a App) uploadFilePage(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/files.tmpl")
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/files.tmpl", "templates/upload-options.tmpl")
 	if err != nil {
 		a.Logger.Error("GET /files: parsing template: %v", err)
 		internalServerError(w)
@@ -193,6 +233,8 @@ func (a App) uploadFilePage(w http.ResponseWriter, r *http.Request) {
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
 	})
 	if err != nil {
 		a.Logger.Error("GET /files: executing template: %v", err)
@@ -202,45 +244,43 @@ func (a App) uploadFilePage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a App) uploadFileAction(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(1 << 20) // 1 MB (max. upload size)
-	if err != nil {
-		a.Logger.Error("POST /files: parsing multipart form: %v", err)
-		internalServerError(w)
-		return
-	}
-	uploadedFile, header, err := r.FormFile("uploadedFile")
+	form, err := a.readUploadForm(r, "uploadedFile")
 	if err != nil {
-		a.Logger.Error("POST /files: get form file: %v", err)
-		internalServerError(w)
-		return
-	}
-	destFile, err := os.Create(filepath.Join(cfg.Storage.UploadedFilesDir, header.Filename))
-	if err != nil {
-		a.Logger.Error("POST /files: creating file: %v", err)
-		internalServerError(w)
+		a.Logger.Error("POST /files: %v", err)
+		uploadError(w, r, err)
 		return
 	}
-	err = destFile.Chmod(0600)
+	expires, err := parseExpiry(form.Values.Get("expires"))
 	if err != nil {
-		a.Logger.Error("POST /files: changing file perms: %v", err)
-		internalServerError(w)
+		a.discardBlob(r.Context(), form.blob)
+		a.Logger.Error("POST /files: %v", err)
+		http.Error(w, "Invalid expiration", http.StatusBadRequest)
 		return
 	}
-	_, err = io.Copy(destFile, uploadedFile)
+	visibility, err := parseVisibility(form.Values.Get("visibility"))
 	if err != nil {
-		a.Logger.Error("POST /files: writing file: %v", err)
-		internalServerError(w)
+		a.discardBlob(r.Context(), form.blob)
+		a.Logger.Error("POST /files: %v", err)
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
 		return
 	}
 
-	title := r.PostForm.Get("title")
+	title := form.Values.Get("title")
 	if title == "" {
-		title = header.Filename
+		title = form.Filename
 	}
-	id, err := a.uploadedFiles.Insert(title, sessionManager.GetString(r.Context(), "user"), header.Filename)
+	f := &models.UploadedFile{
+		Title:            title,
+		Uploader:         currentUser(r),
+		Filename:         form.Filename,
+		Expires:          expires,
+		BurnAfterReading: form.Values.Has("burn"),
+		Visibility:       visibility,
+	}
+	err = a.commitUpload(r.Context(), f, form.blob)
 	if err != nil {
 		a.Logger.Error("POST /files: %v", err)
-		internalServerError(w)
+		uploadError(w, r, err)
 		return
 	}
 
@@ -253,8 +293,10 @@ func (a App) uploadFileAction(w http.ResponseWriter, r *http.Request) {
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
 
-		"Link": fmt.Sprintf("%s://%s/u/%d", cfg.HTTP.Schema, cfg.HTTP.DomainName, id),
+		"Link": fmt.Sprintf("%s://%s/u/%s", cfg.HTTP.Schema, cfg.HTTP.DomainName, f.Slug),
 	})
 	if err != nil {
 		a.Logger.Error("POST /files: executing template: %v", err)
@@ -263,28 +305,91 @@ func (a App) uploadFileAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a App) textPage(w http.ResponseWriter, r *http.Request) {
-	fileID, err := strconv.Atoi(chi.URLParam(r, "fileID"))
+// rawUploadAction handles uploads whose request body is the file itself, as
+// made by "curl -T file https://hermes/" (a PUT to /file, see routeRawPuts)
+// or by "curl --data-binary @- https://hermes/" (a POST to /). The response
+// is the URL of the upload, in plain text. The title, expiration, burn after
+// reading and visibility options can be set with the "title", "expires",
+// "burn" and "visibility" query parameters.
+func (a App) rawUploadAction(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " /"
+	query := r.URL.Query()
+
+	expires, err := parseExpiry(query.Get("expires"))
 	if err != nil {
-		a.Logger.Error("GET /t/: %v", err)
-		http.Error(w, "File not found", http.StatusNotFound)
+		a.Logger.Error("%s: %v", route, err)
+		http.Error(w, "Invalid expiration", http.StatusBadRequest)
 		return
 	}
-	f, err := a.uploadedFiles.Get(fileID)
+	visibility, err := parseVisibility(query.Get("visibility"))
 	if err != nil {
-		a.Logger.Error("GET /t/: %v", err)
-		http.Error(w, "File not found", http.StatusNotFound)
+		a.Logger.Error("%s: %v", route, err)
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	f := &models.UploadedFile{
+		Title:            query.Get("title"),
+		Uploader:         currentUser(r),
+		Expires:          expires,
+		BurnAfterReading: query.Has("burn"),
+		Visibility:       visibility,
+	}
+
+	if name := strings.TrimPrefix(r.URL.Path, "/"); name != "" {
+		f.Filename, err = sanitizeFilename(name)
+		if err != nil {
+			a.Logger.Error("%s: %v", route, err)
+			http.Error(w, "Invalid filename", http.StatusBadRequest)
+			return
+		}
+	}
+
+	blob, err := a.stageBlob(r.Context(), r.Body, r.ContentLength)
+	if err != nil {
+		a.Logger.Error("%s: %v", route, err)
+		uploadError(w, r, err)
+		return
+	}
+	if f.Filename == "" {
+		// Piped from a command, so the name is made up, with the extension
+		// of whatever was piped.
+		ext := extensionByType(http.DetectContentType(blob.head))
+		if f.Filename, err = generateTextFileName(ext); err != nil {
+			a.discardBlob(r.Context(), blob)
+			a.Logger.Error("%s: generating filename: %v", route, err)
+			internalServerError(w)
+			return
+		}
+	}
+	if f.Title == "" {
+		f.Title = f.Filename
+	}
+	if err := a.commitUpload(r.Context(), f, blob); err != nil {
+		a.Logger.Error("%s: %v", route, err)
+		uploadError(w, r, err)
 		return
 	}
+	link := absoluteURL(f.FileHref())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", link)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, link)
+}
 
-	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/t.tmpl")
+func (a App) textPage(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.uploadFromURL(w, r, "/t/")
+	if !ok {
+		return
+	}
+
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/t.tmpl", "templates/upload-actions.tmpl")
 	if err != nil {
 		a.Logger.Error("GET /t/: parsing template: %v", err)
 		internalServerError(w)
 		return
 	}
-	rawText, err := os.ReadFile(filepath.Join(cfg.Storage.UploadedFilesDir, f.FilePath))
-	if errors.Is(err, os.ErrNotExist) {
+	rawFile, err := a.openUpload(r.Context(), f)
+	if errors.Is(err, storage.ErrNotExist) {
 		a.Logger.Error("GET /t/: reading file: %v", err)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
@@ -293,13 +398,54 @@ func (a App) textPage(w http.ResponseWriter, r *http.Request) {
 		internalServerError(w)
 		return
 	}
+	defer rawFile.Close()
+	rawText, err := io.ReadAll(rawFile)
+	if err != nil {
+		a.Logger.Error("GET /t/: reading file: %v", err)
+		internalServerError(w)
+		return
+	}
+	language := f.Language
+	if language == "" {
+		language = guessLanguage(f.Filename, string(rawText))
+	}
+	highlighted, err := highlight(language, string(rawText))
+	if err != nil {
+		a.Logger.Error("GET /t/: highlighting file: %v", err)
+		internalServerError(w)
+		return
+	}
+	var rendered string
+	if isMarkdown(f) {
+		rendered, err = renderMarkdown(string(rawText))
+		if err != nil {
+			a.Logger.Error("GET /t/: %v", err)
+			internalServerError(w)
+			return
+		}
+	}
+	canModify, err := a.canModify(r, f)
+	if err != nil {
+		a.Logger.Error("GET /t/: getting role of user %q: %v", currentUser(r), err)
+		internalServerError(w)
+		return
+	}
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
-
-		"HermesHref": fmt.Sprintf("%s://%s", cfg.HTTP.Schema, cfg.HTTP.DomainName),
-		"File":       f,
-		"Text":       string(rawText),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
+
+		"File":     f,
+		"RawHref":  rawFileURL(f),
+		"Language": language,
+		// Highlighted and rendered texts are made safe by highlight and
+		// renderMarkdown.
+		"Highlighted":  template.HTML(highlighted),
+		"HighlightCSS": template.CSS(highlightCSS()),
+		"Rendered":     template.HTML(rendered),
+		// Texts burned after reading are already gone.
+		"CanModify": canModify && !f.BurnAfterReading,
 	})
 	if err != nil {
 		a.Logger.Error("GET /t/: executing template: %v", err)
@@ -309,20 +455,12 @@ func (a App) textPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a App) filePage(w http.ResponseWriter, r *http.Request) {
-	fileID, err := strconv.Atoi(chi.URLParam(r, "fileID"))
-	if err != nil {
-		a.Logger.Error("GET /u/: %v", err)
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-	f, err := a.uploadedFiles.Get(fileID)
-	if err != nil {
-		a.Logger.Error("GET /u/: %v", err)
-		http.Error(w, "File not found", http.StatusNotFound)
+	f, ok := a.uploadFromURL(w, r, "/u/")
+	if !ok {
 		return
 	}
 
-	if _, err := os.Stat(filepath.Join(cfg.Storage.UploadedFilesDir, f.FilePath)); errors.Is(err, os.ErrNotExist) {
+	if _, err := a.storage.Stat(r.Context(), f.Digest); errors.Is(err, storage.ErrNotExist) {
 		a.Logger.Error("GET /u/: reading file: %v", err)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
@@ -332,18 +470,27 @@ func (a App) filePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/u.tmpl")
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/u.tmpl", "templates/upload-actions.tmpl")
 	if err != nil {
 		a.Logger.Error("GET /u/: parsing template: %v", err)
 		internalServerError(w)
 		return
 	}
+	canModify, err := a.canModify(r, f)
+	if err != nil {
+		a.Logger.Error("GET /u/: getting role of user %q: %v", currentUser(r), err)
+		internalServerError(w)
+		return
+	}
 	err = tmpl.Execute(w, map[string]any{
 		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
 		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
 
-		"HermesHref": fmt.Sprintf("%s://%s", cfg.HTTP.Schema, cfg.HTTP.DomainName),
-		"File":       f,
+		"File":      f,
+		"RawHref":   rawFileURL(f),
+		"CanModify": canModify,
 	})
 	if err != nil {
 		a.Logger.Error("GET /u/: executing template: %v", err)
@@ -353,21 +500,13 @@ func (a App) filePage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a App) getRawFile(w http.ResponseWriter, r *http.Request) {
-	fileID, err := strconv.Atoi(chi.URLParam(r, "fileID"))
-	if err != nil {
-		a.Logger.Error("GET /dl/: %v", err)
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-	u, err := a.uploadedFiles.Get(fileID)
-	if err != nil {
-		a.Logger.Error("GET /dl/: %v", err)
-		http.Error(w, "File not found", http.StatusNotFound)
+	u, ok := a.uploadFromURL(w, r, "/dl/")
+	if !ok {
 		return
 	}
 
-	f, err := os.Open(filepath.Join(cfg.Storage.UploadedFilesDir, u.FilePath))
-	if errors.Is(err, os.ErrNotExist) {
+	f, err := a.openUpload(r.Context(), u)
+	if errors.Is(err, storage.ErrNotExist) {
 		a.Logger.Error("GET /dl/: reading file: %v", err)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
@@ -377,7 +516,39 @@ func (a App) getRawFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer f.Close()
-	http.ServeContent(w, r, u.FilePath, u.Created, f)
+	setUserContentHeaders(w, u)
+	http.ServeContent(w, r, u.Filename, u.Created, f)
+}
+
+// uploadFromURL returns the uploaded file named by the slug in the URL of
+// a route under prefix, if the user making the request may see it. Numeric
+// IDs, which links used before uploads had slugs, are redirected to the slug
+// URL. If ok is false, a response has already been written.
+func (a App) uploadFromURL(w http.ResponseWriter, r *http.Request, prefix string) (f *models.UploadedFile, ok bool) {
+	slug := chi.URLParam(r, "slug")
+	if id, err := strconv.Atoi(slug); err == nil {
+		f, err := a.uploadedFiles.GetByLegacyID(id)
+		if err != nil {
+			a.Logger.Error("GET %s: %v", prefix, err)
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Redirect(w, r, prefix+f.Slug, http.StatusMovedPermanently)
+		return nil, false
+	}
+
+	f, err := a.uploadedFiles.Get(slug)
+	if err != nil {
+		a.Logger.Error("GET %s: %v", prefix, err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !canView(r, f) {
+		// Private files aren't told apart from missing ones.
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	return f, true
 }
 
 func unauthorized(w http.ResponseWriter) {
@@ -385,6 +556,12 @@ func unauthorized(w http.ResponseWriter) {
 	fmt.Fprintln(w, "You must be logged in to perform this action.")
 }
 
+// forbidden returns a Forbidden response.
+func forbidden(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintln(w, message)
+}
+
 // methodNotAllowed returns a Method Not Allowed response.
 func methodNotAllowed(w http.ResponseWriter, allowedMethods []string) {
 	w.Header().Add("Allow", strings.Join(allowedMethods, ", "))
@@ -398,6 +575,11 @@ func internalServerError(w http.ResponseWriter) {
 	fmt.Fprintln(w, "Internal Server Error")
 }
 
+// absoluteURL returns the absolute URL of a path of this hermes instance.
+func absoluteURL(path string) string {
+	return fmt.Sprintf("%s://%s%s", cfg.HTTP.Schema, cfg.HTTP.DomainName, path)
+}
+
 // sendTo redirects the user to the given webpage after a POST or PUT.
 //
 // See: https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/303
@@ -406,56 +588,65 @@ func sendTo(w http.ResponseWriter, path string) {
 	w.WriteHeader(http.StatusSeeOther)
 }
 
-// authenticateUser authenticates the user and creates a new session.
-func authenticateUser(r *http.Request, username, password string) error {
-	db, err := sql.Open("sqlite3", cfg.Storage.DBPath)
-	if err != nil {
-		return err
+// authenticateUser checks the password of a user logging in. Users who have
+// enabled TOTP must then enter a code (see loginTOTPAction), and the others
+// are logged in right away.
+func (a App) authenticateUser(r *http.Request, username, password string) (totpNeeded bool, err error) {
+	if err := a.checkPassword(r, username, password); err != nil {
+		return false, err
 	}
-	defer db.Close()
-	stmt, err := db.Prepare(`select salt, hash from users where username = ?`)
+	secret, _, err := a.users.TOTP(username)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer stmt.Close()
-	var saltHex, hashHex string
-	err = stmt.QueryRow(username).Scan(&saltHex, &hashHex)
-	if err != nil {
-		return errors.New("user not found")
+	if secret != "" {
+		startTOTPLogin(r.Context(), username)
+		return true, nil
 	}
+	return false, a.logIn(r, username)
+}
 
-	// Decode salt and saved hash to bytes.
-	salt, err := hex.DecodeString(saltHex)
+// logIn saves the authentication and role of a user to their session, under
+// a new session token.
+func (a App) logIn(r *http.Request, username string) error {
+	role, err := a.users.Role(username)
 	if err != nil {
-		return fmt.Errorf("decoding saved salt to bytes: %v", err)
+		return fmt.Errorf("getting role of user %q: %v", username, err)
 	}
-	savedHash, err := hex.DecodeString(hashHex)
-	if err != nil {
-		return fmt.Errorf("decoding saved argon2id hash to bytes: %v", err)
+	if err := sessionManager.RenewToken(r.Context()); err != nil {
+		return fmt.Errorf("renewing session token: %v", err)
 	}
-
-	// Compute Argon2id key and compare with saved hash.
-	key := argon2.IDKey([]byte(password), salt, 1, 60*1024, 1, 32)
-	if !bytes.Equal(key, savedHash) {
-		return errors.New("incorrect password")
-	}
-
-	// Save user authentication information to session.
+	// The session may have been made short-lived by the login page.
+	sessionManager.SetDeadline(r.Context(), time.Now().Add(sessionManager.Lifetime))
+	a.logins.succeed(username)
 	sessionManager.Put(r.Context(), "authenticated", true)
 	sessionManager.Put(r.Context(), "user", username)
-
+	sessionManager.Put(r.Context(), "role", role)
+	sessionManager.Put(r.Context(), "logged_in_at", time.Now().Unix())
+	sessionManager.Put(r.Context(), "ip", clientIP(r))
+	sessionManager.Put(r.Context(), "user_agent", r.UserAgent())
+	newCSRFToken(r.Context())
 	return nil
 }
 
 func loggedIn(r *http.Request) bool {
-	return sessionManager.GetBool(r.Context(), "authenticated")
+	return requestToken(r) != nil || sessionManager.GetBool(r.Context(), "authenticated")
+}
+
+// currentUser returns the name of the user making the request, or "" if
+// they aren't logged in.
+func currentUser(r *http.Request) string {
+	if t := requestToken(r); t != nil {
+		return t.Username
+	}
+	return sessionManager.GetString(r.Context(), "user")
 }
 
 const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
-// generateTextFileName generates a filename for an uploaded text file.
-func generateTextFileName() (string, error) {
-	identifier := make([]byte, 8)
+// randomIdentifier generates a random string of n letters.
+func randomIdentifier(n int) (string, error) {
+	identifier := make([]byte, n)
 	for i := range identifier {
 		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
 		if err != nil {
@@ -463,8 +654,46 @@ func generateTextFileName() (string, error) {
 		}
 		identifier[i] = letters[n.Int64()]
 	}
+	return string(identifier), nil
+}
+
+// generateSlug generates the slug of an uploaded file.
+func generateSlug() (string, error) {
+	return randomIdentifier(10)
+}
+
+// generateTextFileName generates a filename for an uploaded text file, with
+// the given extension.
+func generateTextFileName(ext string) (string, error) {
+	identifier, err := randomIdentifier(8)
+	if err != nil {
+		return "", err
+	}
+	return identifier + ext, nil
+}
+
+// expiryDurations are the lifetimes an upload can be given, as chosen in the
+// upload forms. An empty choice means the upload never expires.
+var expiryDurations = map[string]time.Duration{
+	"":      0,
+	"never": 0,
+	"1h":    time.Hour,
+	"1d":    24 * time.Hour,
+	"1w":    7 * 24 * time.Hour,
+}
 
-	return fmt.Sprintf("%s.txt", identifier), nil
+// parseExpiry returns the expiration time of an upload made now with the
+// given lifetime choice. The zero time means it never expires.
+func parseExpiry(choice string) (time.Time, error) {
+	d, ok := expiryDurations[choice]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid expiration %q", choice)
+	}
+	if d == 0 {
+		return time.Time{}, nil
+	}
+	// Stored with a precision of seconds.
+	return time.Now().Add(d).UTC().Truncate(time.Second), nil
 }
 
 // sanitizeFilename returns a filename safe to be served.
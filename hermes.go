@@ -2,12 +2,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
@@ -16,26 +18,54 @@ import (
 	"github.com/pelletier/go-toml/v2"
 
 	"github.com/tsilvap/hermes/internal/models"
+	"github.com/tsilvap/hermes/internal/storage"
 )
 
 type Config struct {
 	HTTP    HTTPConfig    `toml:"http"`
 	Storage StorageConfig `toml:"storage"`
+	Login   LoginConfig   `toml:"login"`
 }
 
 type HTTPConfig struct {
 	Addr       string `toml:"addr"`
 	Schema     string `toml:"schema"`
 	DomainName string `toml:"domain_name"`
+	// UserContentDomain is the domain raw files are served from, if not
+	// DomainName.
+	UserContentDomain string `toml:"user_content_domain"`
 }
 
 type StorageConfig struct {
-	DBPath           string `toml:"db_path"`
-	UploadedFilesDir string `toml:"uploaded_files_dir"`
+	DBPath string `toml:"db_path"`
+	// MaxUploadSize is the maximum size in bytes of an upload request.
+	MaxUploadSize int64 `toml:"max_upload_size"`
+	// KeepImageMetadata keeps the metadata of uploaded images, which is
+	// stripped by default.
+	KeepImageMetadata bool `toml:"keep_image_metadata"`
+	// Backend is where uploaded files are kept: "local" (the default) or
+	// "s3".
+	Backend          string           `toml:"backend"`
+	UploadedFilesDir string           `toml:"uploaded_files_dir"`
+	S3               storage.S3Config `toml:"s3"`
+}
+
+type LoginConfig struct {
+	// PersistRateLimits saves failed logins to the database, so that the
+	// clients they're limiting stay limited across restarts.
+	PersistRateLimits bool `toml:"persist_rate_limits"`
 }
 
 var cfg Config
 
+const usage = `usage: hermes [command]
+
+Without a command, hermes starts the web server.
+
+Commands:
+  user    manage user accounts (see "hermes user")
+`
+
 type StderrLogger struct {
 	logger *log.Logger
 }
@@ -60,7 +90,13 @@ func (l *StderrLogger) Info(format string, a ...any) {
 type App struct {
 	Logger *StderrLogger
 
+	storage       storage.Storage
 	uploadedFiles *models.UploadedFileModel
+	users         *models.UserModel
+	apiTokens     *models.APITokenModel
+	tusUploads    *models.TusUploadModel
+	sessions      *models.SessionModel
+	logins        *loginLimiter
 }
 
 //go:embed static
@@ -97,6 +133,12 @@ func initConfig() {
 	if cfg.Storage.DBPath == "" {
 		cfg.Storage.DBPath = "/var/hermes/hermes.db"
 	}
+	if cfg.Storage.MaxUploadSize == 0 {
+		cfg.Storage.MaxUploadSize = 100 << 20 // 100 MiB
+	}
+	if cfg.Storage.Backend == "" {
+		cfg.Storage.Backend = "local"
+	}
 	if cfg.Storage.UploadedFilesDir == "" {
 		cfg.Storage.UploadedFilesDir = "/var/hermes/uploaded_files/"
 	}
@@ -132,38 +174,132 @@ func main() {
 	}
 	defer db.Close()
 
+	store, err := newStorage(cfg.Storage)
+	if err != nil {
+		logger.Error("initializing storage: %v", err)
+		os.Exit(1)
+	}
+	if err := migrate(context.Background(), db, store, logger); err != nil {
+		logger.Error("%v", err)
+		os.Exit(1)
+	}
+	sessions := &models.SessionModel{DB: db}
+	sessionManager.Store = sessionStore{sessions}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "user":
+			if err := userCommand(&models.UserModel{DB: db}, sessions, os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+			os.Exit(2)
+		}
+	}
+
+	var loginFailures *models.LoginFailureModel
+	if cfg.Login.PersistRateLimits {
+		loginFailures = &models.LoginFailureModel{DB: db}
+	}
+	logins, err := newLoginLimiter(logger, loginFailures)
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(1)
+	}
+
 	app := App{
 		Logger:        logger,
+		storage:       store,
 		uploadedFiles: &models.UploadedFileModel{DB: db},
+		users:         &models.UserModel{DB: db},
+		apiTokens:     &models.APITokenModel{DB: db},
+		tusUploads:    &models.TusUploadModel{DB: db},
+		sessions:      sessions,
+		logins:        logins,
 	}
+	go app.reapExpiredUploads(time.Minute)
+	go app.forgetLoginFailures(time.Hour)
+	go app.deleteExpiredSessions(time.Hour)
+
 	r := appRouter(app)
 	logger.Info("Serving application on http://%s...", cfg.HTTP.Addr)
 	log.Fatal(http.ListenAndServe(cfg.HTTP.Addr, r))
 }
 
+// newStorage returns the storage backend selected in the config.
+func newStorage(cfg StorageConfig) (storage.Storage, error) {
+	switch cfg.Backend {
+	case "local":
+		return storage.NewLocal(cfg.UploadedFilesDir), nil
+	case "s3":
+		return storage.NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
 func appRouter(app App) *chi.Mux {
 	r := chi.NewRouter()
 
+	r.Use(app.separateUserContent)
 	r.Use(sessionManager.LoadAndSave)
+	r.Use(app.authenticateToken)
+	r.Use(app.routeRawPuts)
 
 	r.Handle("/static/*", http.FileServer(http.FS(staticFS)))
 	r.Get("/", app.index)
+	r.With(app.rawUploadAuth()...).Post("/", app.rawUploadAction)
 	r.Route("/login", func(r chi.Router) {
 		r.Get("/", app.loginPage)
-		r.Post("/", app.loginAction)
+		r.With(app.verifyCSRF).Post("/", app.loginAction)
+		r.Get("/totp", app.loginTOTPPage)
+		r.With(app.verifyCSRF).Post("/totp", app.loginTOTPAction)
 	})
-	r.Post("/logout", app.logoutAction)
+	r.With(app.verifyCSRF).Post("/logout", app.logoutAction)
 	r.Route("/text", func(r chi.Router) {
-		r.With(redirectToLogin).Get("/", app.uploadTextPage)
-		r.With(requireLogin).Post("/", app.uploadTextAction)
+		r.With(redirectToLogin, app.requireRole(models.RoleUploader)).Get("/", app.uploadTextPage)
+		r.With(requireLogin, requireScope(models.ScopeUpload), app.requireRole(models.RoleUploader), app.verifyCSRF, limitUploadSize).Post("/", app.uploadTextAction)
 	})
 	r.Route("/files", func(r chi.Router) {
-		r.With(redirectToLogin).Get("/", app.uploadFilePage)
-		r.With(requireLogin).Post("/", app.uploadFileAction)
+		r.With(redirectToLogin, app.requireRole(models.RoleUploader)).Get("/", app.uploadFilePage)
+		r.With(requireLogin, requireScope(models.ScopeUpload), app.requireRole(models.RoleUploader), app.verifyCSRF, limitUploadSize).Post("/", app.uploadFileAction)
+	})
+	r.Route("/tokens", func(r chi.Router) {
+		r.With(redirectToLogin, requireSession).Get("/", app.tokensPage)
+		r.With(requireSession, app.verifyCSRF).Post("/", app.createTokenAction)
+		r.With(requireSession, app.verifyCSRF).Post("/{tokenID}/delete", app.deleteTokenAction)
+	})
+	r.Route("/2fa", func(r chi.Router) {
+		r.With(redirectToLogin, requireSession).Get("/", app.totpPage)
+		r.With(requireSession, app.verifyCSRF).Post("/enable", app.enableTOTPAction)
+		r.With(requireSession, app.verifyCSRF).Post("/disable", app.disableTOTPAction)
+		r.With(requireSession, app.verifyCSRF).Post("/recovery-codes", app.newRecoveryCodesAction)
 	})
-	r.Get("/t/{fileID}", app.textPage)
-	r.Get("/u/{fileID}", app.filePage)
-	r.Get("/dl/{fileID}", app.getRawFile)
+	r.Route("/sessions", func(r chi.Router) {
+		r.With(redirectToLogin, requireSession).Get("/", app.sessionsPage)
+		r.With(requireSession, app.verifyCSRF).Post("/revoke-others", app.revokeOtherSessionsAction)
+		r.With(requireSession, app.verifyCSRF).Post("/{sessionID}/revoke", app.revokeSessionAction)
+	})
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(redirectToLogin, requireSession, app.requireRole(models.RoleAdmin))
+		r.Get("/", app.adminPage)
+		r.Get("/uploads", app.adminUploadsPage)
+		r.With(app.verifyCSRF).Post("/uploads/delete", app.adminDeleteUploadsAction)
+		r.Get("/users", app.adminUsersPage)
+		r.With(app.verifyCSRF).Post("/users", app.adminCreateUserAction)
+		r.With(app.verifyCSRF).Post("/users/{username}/password", app.adminResetPasswordAction)
+		r.With(app.verifyCSRF).Post("/users/{username}/disable", app.adminDisableUserAction)
+		r.With(app.verifyCSRF).Post("/users/{username}/enable", app.adminEnableUserAction)
+	})
+	r.Get("/t/{slug}", app.textPage)
+	r.Get("/u/{slug}", app.filePage)
+	r.Get("/dl/{slug}", app.getRawFile)
+	r.Get("/thumb/{slug}", app.thumbnail)
+	r.Mount("/api/v1", app.apiRouter())
+	r.Mount("/tus", app.tusRouter())
 
 	return r
 }
@@ -191,6 +327,51 @@ func redirectToLogin(next http.Handler) http.Handler {
 	})
 }
 
+// rawUploadAuth returns the middlewares authenticating raw uploads, which
+// are made with curl or similar clients.
+func (app App) rawUploadAuth() []func(http.Handler) http.Handler {
+	return []func(http.Handler) http.Handler{
+		requireTokenLogin,
+		requireScope(models.ScopeUpload),
+		app.requireRole(models.RoleUploader),
+		app.verifyCSRF,
+		limitUploadSize,
+	}
+}
+
+// routeRawPuts sends PUT requests to /{filename} to rawUploadAction. They're
+// routed here rather than in the router, since a /{filename} route would
+// make the router answer 405 instead of 404 to any unknown path.
+func (app App) routeRawPuts(next http.Handler) http.Handler {
+	upload := chi.Chain(app.rawUploadAuth()...).HandlerFunc(app.rawUploadAction)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && !strings.Contains(strings.TrimPrefix(r.URL.Path, "/"), "/") {
+			upload.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireTokenLogin is like requireLogin, but asks clients to authenticate
+// with an API token. Clients trying HTTP basic auth, which isn't accepted
+// (see verifyCSRF), are told so.
+func requireTokenLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loggedIn(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hermes"`)
+			if _, _, ok := r.BasicAuth(); ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, `HTTP basic auth isn't supported. Authenticate with an API token in an "Authorization: Bearer" header instead.`)
+				return
+			}
+			unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func requireLogin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !loggedIn(r) {
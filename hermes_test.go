@@ -1,23 +1,103 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
 
 	"github.com/tsilvap/hermes/internal/models"
+	"github.com/tsilvap/hermes/internal/storage"
 )
 
 func getTestServer() *httptest.Server {
 	logger := NewStderrLogger()
-	app := App{Logger: logger, uploadedFiles: &models.UploadedFileModel{DB: nil}}
+	app := App{
+		Logger:        logger,
+		uploadedFiles: &models.UploadedFileModel{DB: nil},
+		users:         &models.UserModel{DB: nil},
+		apiTokens:     &models.APITokenModel{DB: nil},
+		tusUploads:    &models.TusUploadModel{DB: nil},
+	}
+	app.logins, _ = newLoginLimiter(logger, nil)
 	r := appRouter(app)
 	return httptest.NewServer(r)
 }
 
+// openTestDB opens an empty hermes database in a temporary directory, with
+// the initial schema. If migrated, every migration is applied to it too, with
+// files stored next to it.
+func openTestDB(t *testing.T, migrated bool) (*sql.DB, storage.Storage) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "hermes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(hermesSQL); err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewLocal(filepath.Join(dir, "files"))
+	if migrated {
+		if err := migrate(context.Background(), db, store, NewStderrLogger()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, store
+}
+
+// newTestApp returns an app with a migrated database and storage of its own.
+func newTestApp(t *testing.T) App {
+	t.Helper()
+	db, store := openTestDB(t, true)
+	logger := NewStderrLogger()
+	app := App{
+		Logger:        logger,
+		storage:       store,
+		uploadedFiles: &models.UploadedFileModel{DB: db},
+		users:         &models.UserModel{DB: db},
+		apiTokens:     &models.APITokenModel{DB: db},
+		tusUploads:    &models.TusUploadModel{DB: db},
+		sessions:      &models.SessionModel{DB: db},
+	}
+	app.logins, _ = newLoginLimiter(logger, nil)
+	return app
+}
+
+// blobExists reports whether a blob is in the storage of app.
+func blobExists(t *testing.T, app App, digest string) bool {
+	t.Helper()
+	_, err := app.storage.Stat(context.Background(), digest)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
 func Test200(t *testing.T) {
 	s := getTestServer()
 	defer s.Close()
@@ -40,9 +120,9 @@ func Test404(t *testing.T) {
 		Path string
 	}{
 		{"/notexistent"},
-		{"/t"}, {"/t/"}, {"/t/notexistent"},
-		{"/u"}, {"/u/"}, {"/u/notexistent"},
-		{"/dl"}, {"/dl/"}, {"/dl/notexistent"},
+		{"/t"}, {"/t/"}, {"/t/notexistent"}, {"/t/1"},
+		{"/u"}, {"/u/"}, {"/u/notexistent"}, {"/u/1"},
+		{"/dl"}, {"/dl/"}, {"/dl/notexistent"}, {"/dl/1"},
 	}
 	for _, tc := range testCases {
 		t.Run("GET "+tc.Path, func(t *testing.T) {
@@ -101,3 +181,1381 @@ func Test405(t *testing.T) {
 		})
 	}
 }
+
+func TestParseExpiry(t *testing.T) {
+	for _, choice := range []string{"", "never"} {
+		got, err := parseExpiry(choice)
+		if err != nil || !got.IsZero() {
+			t.Errorf("parseExpiry(%q) = %v, %v, want zero time", choice, got, err)
+		}
+	}
+	got, err := parseExpiry("1d")
+	if err != nil {
+		t.Fatalf("parseExpiry(%q): %v", "1d", err)
+	}
+	if d := time.Until(got); d < 23*time.Hour || d > 24*time.Hour {
+		t.Errorf("parseExpiry(%q) expires in %v, want about 24h", "1d", d)
+	}
+	if _, err := parseExpiry("1y"); err == nil {
+		t.Errorf("parseExpiry(%q) succeeded, want error", "1y")
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	s := getTestServer()
+	defer s.Close()
+
+	testCases := []struct {
+		Method     string
+		Path       string
+		StatusCode int
+		Code       string
+	}{
+		{"GET", "/api/v1/uploads/notexistent", http.StatusNotFound, "not_found"},
+		{"GET", "/api/v1/notexistent", http.StatusNotFound, "not_found"},
+		{"GET", "/api/v1/uploads?limit=1000", http.StatusBadRequest, "invalid_limit"},
+		{"POST", "/api/v1/texts", http.StatusUnauthorized, "unauthorized"},
+		{"DELETE", "/api/v1/uploads/notexistent", http.StatusUnauthorized, "unauthorized"},
+		{"PATCH", "/api/v1/uploads/notexistent", http.StatusUnauthorized, "unauthorized"},
+		{"PUT", "/api/v1/uploads", http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.Method, tc.Path), func(t *testing.T) {
+			req, err := http.NewRequest(tc.Method, s.URL+tc.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := s.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Body.Close()
+			if r.StatusCode != tc.StatusCode {
+				t.Errorf("r.StatusCode = %d, want %d", r.StatusCode, tc.StatusCode)
+			}
+			var body apiError
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatalf("decoding error body: %v", err)
+			}
+			if body.Error.Code != tc.Code {
+				t.Errorf("error code = %q, want %q", body.Error.Code, tc.Code)
+			}
+		})
+	}
+}
+
+func TestAPICreateText(t *testing.T) {
+	app := newTestApp(t)
+	token, err := app.apiTokens.Insert("alice", "test", models.AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.users.Insert("alice", "pw", models.RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(appRouter(app))
+	defer s.Close()
+
+	tests := []struct {
+		text       string
+		statusCode int
+		code       string
+	}{
+		{"hello\n", http.StatusCreated, ""},
+		{"\x00\x01\x02\x03", http.StatusBadRequest, "invalid_body"},
+		{"", http.StatusBadRequest, "invalid_text"},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(map[string]string{"text": tt.text})
+		req, _ := http.NewRequest("POST", s.URL+"/api/v1/texts", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got apiError
+		json.NewDecoder(r.Body).Decode(&got)
+		r.Body.Close()
+		if r.StatusCode != tt.statusCode || got.Error.Code != tt.code {
+			t.Errorf("POST /api/v1/texts with %q = %d %q, want %d %q", tt.text, r.StatusCode, got.Error.Code, tt.statusCode, tt.code)
+		}
+	}
+}
+
+func TestRawUploadRequiresLogin(t *testing.T) {
+	s := getTestServer()
+	defer s.Close()
+
+	for _, method := range []string{"POST", "PUT"} {
+		t.Run(method, func(t *testing.T) {
+			req, err := http.NewRequest(method, s.URL+"/notes.txt", strings.NewReader("hello"))
+			if method == "POST" {
+				req, err = http.NewRequest(method, s.URL+"/", strings.NewReader("hello"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := s.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := r.StatusCode, http.StatusUnauthorized; got != want {
+				t.Errorf("r.StatusCode = %d, want %d", got, want)
+			}
+			if got, want := r.Header.Get("WWW-Authenticate"), `Bearer realm="hermes"`; got != want {
+				t.Errorf("WWW-Authenticate header = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLimitUploadSize(t *testing.T) {
+	defer func(size int64) { cfg.Storage.MaxUploadSize = size }(cfg.Storage.MaxUploadSize)
+	cfg.Storage.MaxUploadSize = 10
+
+	h := limitUploadSize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			uploadError(w, r, err)
+		}
+	}))
+	tests := []struct {
+		path, body string
+		chunked    bool
+		want       int
+	}{
+		{"/files", "small", false, http.StatusOK},
+		{"/files", "much too large", false, http.StatusRequestEntityTooLarge},
+		{"/files", "much too large", true, http.StatusRequestEntityTooLarge},
+		{"/api/v1/files", "much too large", true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Code; got != tt.want {
+			t.Errorf("POST %s (%d bytes, chunked: %t): status = %d, want %d", tt.path, len(tt.body), tt.chunked, got, tt.want)
+		}
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	got, err := parseTusMetadata("filename bm90ZXMudHh0, title  ,burn_after_reading dHJ1ZQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"filename": "notes.txt", "title": "", "burn_after_reading": "true"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseTusMetadata() = %v, want %v", got, want)
+	}
+
+	for _, header := range []string{"filename not-base64!", "title dGl0bGU=,,filename bm90ZXMudHh0"} {
+		if _, err := parseTusMetadata(header); err == nil {
+			t.Errorf("parseTusMetadata(%q) succeeded, want error", header)
+		}
+	}
+}
+
+func TestTusResumable(t *testing.T) {
+	s := getTestServer()
+	defer s.Close()
+
+	req, err := http.NewRequest("OPTIONS", s.URL+"/tus/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("OPTIONS /tus/: r.StatusCode = %d, want %d", got, want)
+	}
+	if got, want := r.Header.Get("Tus-Version"), tusVersion; got != want {
+		t.Errorf("OPTIONS /tus/: Tus-Version header = %q, want %q", got, want)
+	}
+
+	req, err = http.NewRequest("POST", s.URL+"/tus/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	r, err = s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.StatusCode, http.StatusPreconditionFailed; got != want {
+		t.Errorf("POST /tus/: r.StatusCode = %d, want %d", got, want)
+	}
+}
+
+func TestGuessLanguage(t *testing.T) {
+	tests := []struct {
+		filename, text, want string
+	}{
+		{"main.go", "package main\n", "Go"},
+		{"notes.txt", "#!/usr/bin/env python3\nprint('hi')\n", "Python"},
+		{"notes.txt", "#!/bin/bash\necho hi\n", "Bash"},
+		{"notes.txt", "Hello, world!\n", plainText},
+	}
+	for _, tt := range tests {
+		if got := guessLanguage(tt.filename, tt.text); got != tt.want {
+			t.Errorf("guessLanguage(%q, %q) = %q, want %q", tt.filename, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		markdown, want string
+	}{
+		{"# Notes", "<h1>Notes</h1>\n"},
+		{"[docs](https://example.org/)", `<p><a href="https://example.org/" rel="nofollow">docs</a></p>` + "\n"},
+		{"[docs](javascript:alert(1))", "<p>docs</p>\n"},
+		{`<b onclick="alert(1)">bold</b><script>alert(1)</script>`, "<p><b>bold</b></p>\n"},
+	}
+	for _, tt := range tests {
+		got, err := renderMarkdown(tt.markdown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.markdown, got, tt.want)
+		}
+	}
+}
+
+func TestScaleToFit(t *testing.T) {
+	tests := []struct {
+		size image.Point
+		px   int
+		want image.Point
+	}{
+		{image.Pt(1200, 800), 256, image.Pt(256, 170)},
+		{image.Pt(800, 1200), 256, image.Pt(170, 256)},
+		{image.Pt(100, 50), 256, image.Pt(100, 50)},
+		{image.Pt(10000, 1), 128, image.Pt(128, 1)},
+	}
+	for _, tt := range tests {
+		if got := scaleToFit(tt.size, tt.px); got != tt.want {
+			t.Errorf("scaleToFit(%v, %d) = %v, want %v", tt.size, tt.px, got, tt.want)
+		}
+	}
+}
+
+func TestDetectMIMEType(t *testing.T) {
+	// As registered on many systems, which TypeScript files are rejected
+	// by if only their extension is trusted.
+	mime.AddExtensionType(".ts", "video/mp2t")
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	tests := []struct {
+		filename string
+		head     string
+		want     string
+		mismatch bool
+	}{
+		{"shot.png", png, "image/png", false},
+		{"shot", png, "image/png", false},
+		{"shot.jpg", png, "image/png", false},
+		{"notes.md", "# Notes", "text/markdown; charset=utf-8", false},
+		{"main.go", "package main", "text/x-go; charset=utf-8", false},
+		{"data.json", `{"a": 1}`, "application/json", false},
+		{"logo.svg", `<svg xmlns="http://www.w3.org/2000/svg"/>`, "image/svg+xml", false},
+		{"archive.tar", "\x00\x01\x02", "application/x-tar", false},
+		{"main.ts", "const x: number = 1;", "text/plain; charset=utf-8", false},
+		{"stream.ts", "G\x00\x11\x10\x00", "video/mp2t", false},
+		{"x.jpg", "<html><script>alert(1)</script>", "text/html; charset=utf-8", true},
+		{"x.png", "just text", "text/plain; charset=utf-8", true},
+		{"x.txt", png, "image/png", true},
+		{"x.txt", "\x00\x01\x02", "application/octet-stream", true},
+	}
+	for _, tt := range tests {
+		got, err := detectMIMEType(tt.filename, []byte(tt.head))
+		if got != tt.want || errors.Is(err, errMIMEMismatch) != tt.mismatch {
+			t.Errorf("detectMIMEType(%q, %q) = %q, %v, want %q, mismatch %t", tt.filename, tt.head, got, err, tt.want, tt.mismatch)
+		}
+	}
+}
+
+func TestExtensionByType(t *testing.T) {
+	tests := map[string]string{
+		"text/plain; charset=utf-8": ".txt",
+		"text/html; charset=utf-8":  ".txt",
+		"image/png":                 ".png",
+		"image/jpeg":                ".jpeg",
+		"application/x-unknown":     "",
+	}
+	for mimeType, want := range tests {
+		if got := extensionByType(mimeType); got != want {
+			t.Errorf("extensionByType(%q) = %q, want %q", mimeType, got, want)
+		}
+	}
+}
+
+func TestRawUploadWithoutFilename(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.users.Insert("alice", "pw", models.RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.apiTokens.Insert("alice", "test", models.AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(appRouter(app))
+	defer s.Close()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body, wantType string
+	}{
+		{"some output\n", "text/plain; charset=utf-8"},
+		{img.String(), "image/png"},
+		{"\x1f\x8b\x08\x00\x00\x00\x00\x00", "application/x-gzip"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", s.URL+"/", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("POST / of %s: status %d (%s), want 201", tt.wantType, resp.StatusCode, link)
+			continue
+		}
+		slug := strings.TrimSpace(string(link[bytes.LastIndexByte(link, '/')+1:]))
+		f, err := app.uploadedFiles.Get(slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.MIMEType != tt.wantType {
+			t.Errorf("POST / of %s: %s stored as %s", tt.wantType, f.Filename, f.MIMEType)
+		}
+	}
+}
+
+func TestIsPassiveContent(t *testing.T) {
+	tests := map[string]bool{
+		"image/png":                 true,
+		"video/mp4":                 true,
+		"text/plain; charset=utf-8": true,
+		"text/markdown":             true,
+		"application/json":          true,
+		"text/html; charset=utf-8":  false,
+		"image/svg+xml":             false,
+		"text/xml; charset=utf-8":   false,
+		"text/javascript":           false,
+		"application/xhtml+xml":     false,
+		"application/pdf":           false,
+		"application/octet-stream":  false,
+		"":                          false,
+	}
+	for mimeType, want := range tests {
+		if got := isPassiveContent(mimeType); got != want {
+			t.Errorf("isPassiveContent(%q) = %t, want %t", mimeType, got, want)
+		}
+	}
+}
+
+func TestSeparateUserContent(t *testing.T) {
+	defer func(domain string) { cfg.HTTP.UserContentDomain = domain }(cfg.HTTP.UserContentDomain)
+	cfg.HTTP.UserContentDomain = "usercontent.example.net"
+
+	handler := App{}.separateUserContent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		host, path string
+		want       int
+	}{
+		{"usercontent.example.net", "/dl/abc", http.StatusOK},
+		{"usercontent.example.net", "/", http.StatusNotFound},
+		{"usercontent.example.net", "/login", http.StatusNotFound},
+		{cfg.HTTP.DomainName, "/dl/abc", http.StatusFound},
+		{cfg.HTTP.DomainName, "/u/abc", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("GET %s%s: status = %d, want %d", tt.host, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestVerifyCSRF(t *testing.T) {
+	app := App{Logger: NewStderrLogger()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, newCSRFToken(r.Context()))
+	})
+	mux.Handle("/", app.verifyCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+	s := httptest.NewServer(sessionManager.LoadAndSave(mux))
+	defer s.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	r, err := client.Get(s.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := string(b)
+
+	multipartBody := func(fields ...string) (string, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for i := 0; i < len(fields); i += 2 {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		mw.Close()
+		return mw.FormDataContentType(), body.String()
+	}
+	formType := "application/x-www-form-urlencoded"
+	tokenFirstType, tokenFirst := multipartBody("csrf_token", token, "file", "contents")
+	tokenLastType, tokenLast := multipartBody("file", "contents", "csrf_token", token)
+	tests := []struct {
+		name              string
+		contentType, body string
+		header            string
+		want              int
+	}{
+		{"form", formType, "csrf_token=" + token, "", http.StatusOK},
+		{"form without token", formType, "title=x", "", http.StatusForbidden},
+		{"form with wrong token", formType, "csrf_token=x" + token, "", http.StatusForbidden},
+		{"header", "application/json", "{}", token, http.StatusOK},
+		{"wrong header", "application/json", "{}", "x", http.StatusForbidden},
+		{"raw body", "text/plain", "csrf_token=" + token, "", http.StatusForbidden},
+		{"multipart", tokenFirstType, tokenFirst, "", http.StatusOK},
+		{"multipart with token last", tokenLastType, tokenLast, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", s.URL+"/", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.header != "" {
+			req.Header.Set(csrfTokenHeader, tt.header)
+		}
+		r, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, r.StatusCode, tt.want)
+		}
+		if r.StatusCode == http.StatusOK && tt.contentType != formType && string(got) != tt.body {
+			t.Errorf("%s: handler read body %q, want %q", tt.name, got, tt.body)
+		}
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	l, err := newLoginLimiter(NewStderrLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < userLoginPolicy.freeFailures; i++ {
+		l.fail("192.0.2.1", "alice")
+	}
+	if wait := l.wait("192.0.2.1", "alice"); wait != 0 {
+		t.Errorf("after %d failures, wait = %v, want 0", userLoginPolicy.freeFailures, wait)
+	}
+	l.fail("192.0.2.1", "alice")
+	if wait := l.wait("192.0.2.2", "alice"); wait <= 0 || wait > loginBackoff {
+		t.Errorf("after %d failures, wait = %v, want up to %v", userLoginPolicy.freeFailures+1, wait, loginBackoff)
+	}
+	if wait := l.wait("192.0.2.1", "bob"); wait != 0 {
+		t.Errorf("wait for another user = %v, want 0", wait)
+	}
+	for i := userLoginPolicy.freeFailures + 1; i < userLoginPolicy.lockoutFailures; i++ {
+		l.fail("192.0.2.1", "alice")
+	}
+	if wait := l.wait("192.0.2.2", "alice"); wait < loginLockout-time.Minute {
+		t.Errorf("after %d failures, wait = %v, want %v", userLoginPolicy.lockoutFailures, wait, loginLockout)
+	}
+	l.succeed("alice")
+	if wait := l.wait("192.0.2.2", "alice"); wait != 0 {
+		t.Errorf("after logging in, wait = %v, want 0", wait)
+	}
+
+	for i := userLoginPolicy.lockoutFailures; i < ipLoginPolicy.lockoutFailures; i++ {
+		l.fail("192.0.2.1", fmt.Sprintf("user%d", i))
+	}
+	if wait := l.wait("192.0.2.1", "carol"); wait < loginLockout-time.Minute {
+		t.Errorf("after %d failures from an IP address, wait = %v, want %v", ipLoginPolicy.lockoutFailures, wait, loginLockout)
+	}
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.users.Insert("alice", "right", models.RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+
+	// Logging in doesn't count as a failure.
+	for i := 0; i <= userLoginPolicy.freeFailures; i++ {
+		if err := app.checkPassword(r, "alice", "right"); err != nil {
+			t.Fatalf("checkPassword() = %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var checked, limited int
+	var wg sync.WaitGroup
+	for i := 0; i < 4*userLoginPolicy.lockoutFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := app.checkPassword(r, "alice", "wrong")
+			var tooMany *tooManyLoginsError
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, models.ErrInvalidCredentials):
+				checked++
+			case errors.As(err, &tooMany):
+				limited++
+			default:
+				t.Errorf("checkPassword() = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if want := userLoginPolicy.freeFailures + 1; checked != want {
+		t.Errorf("%d concurrent wrong passwords were checked, want %d before having to wait", checked, want)
+	}
+	if limited == 0 {
+		t.Errorf("no concurrent login attempt was limited")
+	}
+}
+
+func TestLoginTOTPWithoutPassword(t *testing.T) {
+	s := getTestServer()
+	defer s.Close()
+	client := s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	r, err := client.Get(s.URL + "/login/totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusSeeOther || r.Header.Get("Location") != "/login" {
+		t.Errorf("GET /login/totp = %d %q, want %d %q", r.StatusCode, r.Header.Get("Location"), http.StatusSeeOther, "/login")
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	app := newTestApp(t)
+	defer func(store scs.Store) { sessionManager.Store = store }(sessionManager.Store)
+	sessionManager.Store = sessionStore{app.sessions}
+
+	newSession := func(username string) context.Context {
+		ctx, err := sessionManager.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			sessionManager.Put(ctx, "authenticated", true)
+			sessionManager.Put(ctx, "user", username)
+		}
+		token, _, err := sessionManager.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, err = sessionManager.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+	alice := newSession("session-alice")
+	newSession("session-alice")
+	bob := newSession("session-bob")
+	anonymous := newSession("")
+
+	sessions, err := userSessions(alice, app.sessions, "session-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Current == sessions[1].Current {
+		t.Fatalf("sessions of alice = %+v, want 2, one of them current", sessions)
+	}
+	var expires time.Time
+	err = app.sessions.DB.QueryRow(`SELECT expires_at FROM sessions WHERE token = ?`, sessionManager.Token(anonymous)).Scan(&expires)
+	if err != nil || expires.After(time.Now().Add(anonymousSessionLifetime+time.Minute)) {
+		t.Errorf("anonymous session is stored until %v (%v), want at most %v from now", expires, err, anonymousSessionLifetime)
+	}
+
+	current := sessionID(sessionManager.Token(alice))
+	n, err := revokeSessions(app.sessions, "session-alice", func(id string) bool { return id != current })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("revoked %d sessions, want 1", n)
+	}
+	if sessions, err := userSessions(alice, app.sessions, "session-alice"); err != nil || len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("sessions of alice after revoking others = %+v, %v, want the current one", sessions, err)
+	}
+	if sessions, err := userSessions(bob, app.sessions, "session-bob"); err != nil || len(sessions) != 1 {
+		t.Errorf("sessions of bob = %+v, %v, want 1", sessions, err)
+	}
+}
+
+func TestMigrateSessionUsers(t *testing.T) {
+	ctx := context.Background()
+	db, store := openTestDB(t, false)
+	defer func(all []func(m *migrator) error) { migrations = all }(migrations)
+	migrations = migrations[:len(migrations)-1]
+	if err := migrate(ctx, db, store, NewStderrLogger()); err != nil {
+		t.Fatal(err)
+	}
+	migrations = migrations[:len(migrations)+1]
+
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	insert := func(token string, values map[string]any) {
+		data, err := sessionManager.Codec.Encode(expires, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO sessions(token, data, expires_at) VALUES(?, ?, ?)`, token, data, expires.UTC().Format(time.DateTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("alice", map[string]any{"authenticated": true, "user": "alice"})
+	insert("anonymous", map[string]any{"csrf_token": "x"})
+	if err := migrate(ctx, db, store, NewStderrLogger()); err != nil {
+		t.Fatalf("migrate() = %v", err)
+	}
+
+	sessions := &models.SessionModel{DB: db}
+	if data, err := sessions.OfUser("alice"); err != nil || len(data) != 1 || data["alice"] == nil {
+		t.Errorf("sessions of alice = %v, %v, want the alice session", data, err)
+	}
+	var anonymousExpires time.Time
+	err := db.QueryRow(`SELECT expires_at FROM sessions WHERE token = 'anonymous'`).Scan(&anonymousExpires)
+	if err != nil || anonymousExpires.After(time.Now().Add(anonymousSessionLifetime+time.Minute)) {
+		t.Errorf("anonymous session is stored until %v (%v), want at most %v from now", anonymousExpires, err, anonymousSessionLifetime)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	app := App{Logger: NewStderrLogger(), users: &models.UserModel{DB: nil}}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		role, required string
+		want           int
+	}{
+		{"", models.RoleViewer, http.StatusForbidden},
+		{models.RoleViewer, models.RoleViewer, http.StatusOK},
+		{models.RoleViewer, models.RoleUploader, http.StatusForbidden},
+		{models.RoleUploader, models.RoleUploader, http.StatusOK},
+		{models.RoleUploader, models.RoleAdmin, http.StatusForbidden},
+		{models.RoleAdmin, models.RoleUploader, http.StatusOK},
+		{models.RoleAdmin, models.RoleAdmin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.role != "" {
+				sessionManager.Put(r.Context(), "authenticated", true)
+				sessionManager.Put(r.Context(), "user", "alice")
+				sessionManager.Put(r.Context(), "role", tt.role)
+			}
+			app.requireRole(tt.required)(ok).ServeHTTP(w, r)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.want {
+			t.Errorf("role %q requiring %q: status = %d, want %d", tt.role, tt.required, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminUploadFilter(t *testing.T) {
+	query, _ := url.ParseQuery("uploader=alice&type=image&since=2024-01-01&until=2024-01-31&min_size=1&max_size=2048")
+	got, err := adminUploadFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.UploadedFileFilter{
+		Uploader:                "alice",
+		Type:                    "image",
+		Since:                   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:                   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		MinSize:                 1 << 10,
+		MaxSize:                 2 << 20,
+		IncludeBurnAfterReading: true,
+		AllVisibilities:         true,
+	}
+	if got != want {
+		t.Errorf("adminUploadFilter() = %+v, want %+v", got, want)
+	}
+
+	for _, q := range []string{"since=yesterday", "until=2024-13-01", "min_size=-1", "max_size=1.5"} {
+		query, _ := url.ParseQuery(q)
+		if _, err := adminUploadFilter(query); err == nil {
+			t.Errorf("adminUploadFilter(%q) succeeded, want error", q)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		n    byteSize
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := tt.n.String(); got != tt.want {
+			t.Errorf("byteSize(%d) = %q, want %q", int64(tt.n), got, tt.want)
+		}
+	}
+}
+
+func TestParseVisibility(t *testing.T) {
+	for choice, want := range map[string]string{"": "public", "unlisted": "unlisted", "private": "private"} {
+		if got, err := parseVisibility(choice); err != nil || got != want {
+			t.Errorf("parseVisibility(%q) = %q, %v, want %q", choice, got, err, want)
+		}
+	}
+	if _, err := parseVisibility("secret"); err == nil {
+		t.Errorf("parseVisibility(%q) succeeded, want error", "secret")
+	}
+}
+
+func TestCanView(t *testing.T) {
+	private := &models.UploadedFile{Slug: "AbCdEfGhIj", Uploader: "alice", Visibility: models.VisibilityPrivate}
+	other := &models.UploadedFile{Slug: "KlMnOpQrSt", Uploader: "alice", Visibility: models.VisibilityPrivate}
+	signed := signRawURL(private, time.Now().Add(time.Minute)).Encode()
+	expired := signRawURL(private, time.Now().Add(-time.Minute)).Encode()
+
+	tests := []struct {
+		f     *models.UploadedFile
+		query string
+		want  bool
+	}{
+		{&models.UploadedFile{Visibility: models.VisibilityPublic}, "", true},
+		{&models.UploadedFile{Visibility: models.VisibilityUnlisted}, "", true},
+		{private, "", false},
+		{private, signed, true},
+		{private, expired, false},
+		{other, signed, false},
+	}
+	for _, tt := range tests {
+		var got bool
+		h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = canView(r, tt.f)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dl/"+tt.f.Slug+"?"+tt.query, nil))
+		if got != tt.want {
+			t.Errorf("canView(%s %s, %q) = %v, want %v", tt.f.Visibility, tt.f.Slug, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateUniqueUsernames(t *testing.T) {
+	db, store := openTestDB(t, false)
+	_, err := db.Exec(`INSERT INTO users(username, salt, hash) VALUES('alice', '', ''), ('bob', '', ''), ('alice', '', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrate(context.Background(), db, store, NewStderrLogger())
+	if err == nil || !strings.Contains(err.Error(), `"alice"`) || strings.Contains(err.Error(), `"bob"`) {
+		t.Fatalf("migrate() = %v, want error naming alice", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM users WHERE rowid = 3`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(context.Background(), db, store, NewStderrLogger()); err != nil {
+		t.Fatalf("migrate() = %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users(username, salt, hash) VALUES('bob', '', '')`); err == nil {
+		t.Errorf("inserting a second bob succeeded, want error")
+	}
+}
+
+func TestMigrateContentAddressedBlobs(t *testing.T) {
+	ctx := context.Background()
+	db, store := openTestDB(t, false)
+	_, err := db.Exec(`INSERT INTO uploaded_files(title, uploader, file_path, created_at) VALUES
+('a', 'alice', 'a.txt', datetime('now')), ('b', 'alice', 'a.txt', datetime('now')), ('c', 'alice', 'c.txt', datetime('now'))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "a.txt", strings.NewReader("hello\n"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// c.txt is missing, which stops the migration without losing its upload.
+	if err := migrate(ctx, db, store, NewStderrLogger()); err == nil || !strings.Contains(err.Error(), "c.txt") {
+		t.Fatalf("migrate() = %v, want error about c.txt", err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM uploaded_files`).Scan(&n); err != nil || n != 3 {
+		t.Fatalf("%d uploaded files left (%v), want 3", n, err)
+	}
+
+	if err := store.Put(ctx, "c.txt", strings.NewReader("hello\n"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(ctx, db, store, NewStderrLogger()); err != nil {
+		t.Fatalf("migrate() = %v", err)
+	}
+	var refcount int
+	if err := db.QueryRow(`SELECT count(*), sum(refcount) FROM blobs`).Scan(&n, &refcount); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || refcount != 3 {
+		t.Errorf("got %d blobs referenced %d times, want 1 blob referenced 3 times", n, refcount)
+	}
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if _, err := store.Stat(ctx, name); !errors.Is(err, storage.ErrNotExist) {
+			t.Errorf("old file %s: Stat() = %v, want ErrNotExist", name, err)
+		}
+	}
+}
+
+func TestBlobDeduplication(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	a := &models.UploadedFile{Title: "a", Uploader: "alice"}
+	b := &models.UploadedFile{Title: "b", Uploader: "bob"}
+	for _, f := range []*models.UploadedFile{a, b} {
+		if err := app.saveText(ctx, f, "same contents\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Digest != b.Digest {
+		t.Fatalf("digests %s and %s differ, want the same blob", a.Digest, b.Digest)
+	}
+	if a.Filename == b.Filename {
+		t.Errorf("both uploads are named %s, want their own filenames", a.Filename)
+	}
+
+	if err := app.deleteUpload(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(t, app, b.Digest) {
+		t.Fatalf("blob deleted while b still references it")
+	}
+	got, err := app.uploadedFiles.Get(b.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := app.openUpload(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(contents) != "same contents\n" {
+		t.Errorf("contents of b = %q", contents)
+	}
+
+	if err := app.deleteUpload(ctx, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists(t, app, b.Digest) {
+		t.Errorf("blob kept after its last upload was deleted")
+	}
+	if err := app.deleteUpload(ctx, b.ID); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("deleting b again: %v, want ErrNoRecord", err)
+	}
+}
+
+func TestDeleteExpiredUploads(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	past := time.Now().Add(-time.Minute)
+	expired := &models.UploadedFile{Uploader: "alice", Expires: past}
+	shared := &models.UploadedFile{Uploader: "alice", Expires: past}
+	kept := &models.UploadedFile{Uploader: "alice", Expires: time.Now().Add(time.Hour)}
+	for f, text := range map[*models.UploadedFile]string{expired: "expired\n", shared: "shared\n", kept: "shared\n"} {
+		if err := app.saveText(ctx, f, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := app.uploadedFiles.Get(expired.Slug); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("getting expired upload: %v, want ErrNoRecord", err)
+	}
+
+	if err := app.deleteExpiredUploads(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*models.UploadedFile{expired, shared} {
+		if _, err := app.uploadedFiles.Delete(f.ID); !errors.Is(err, models.ErrNoRecord) {
+			t.Errorf("expired upload %s still in the database (%v)", f.Slug, err)
+		}
+	}
+	if _, err := app.uploadedFiles.Get(kept.Slug); err != nil {
+		t.Errorf("getting unexpired upload: %v", err)
+	}
+	if blobExists(t, app, expired.Digest) {
+		t.Errorf("blob of expired upload kept")
+	}
+	if !blobExists(t, app, kept.Digest) {
+		t.Errorf("blob shared with an unexpired upload deleted")
+	}
+}
+
+func TestOpenBurnAfterReading(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	burned := &models.UploadedFile{Uploader: "alice", BurnAfterReading: true}
+	if err := app.saveText(ctx, burned, "secret\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// However many requests race to read it, only one gets it.
+	const readers = 10
+	var wg sync.WaitGroup
+	results := make(chan string, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := app.uploadedFiles.Get(burned.Slug)
+			if errors.Is(err, models.ErrNoRecord) {
+				return
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			rc, err := app.openUpload(ctx, f)
+			if errors.Is(err, storage.ErrNotExist) {
+				return
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			contents, err := io.ReadAll(rc)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- string(contents)
+		}()
+	}
+	wg.Wait()
+	close(results)
+	var got []string
+	for contents := range results {
+		got = append(got, contents)
+	}
+	if len(got) != 1 || got[0] != "secret\n" {
+		t.Errorf("burned upload read as %q, want read once", got)
+	}
+	if _, err := app.uploadedFiles.Get(burned.Slug); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("getting burned upload: %v, want ErrNoRecord", err)
+	}
+	if blobExists(t, app, burned.Digest) {
+		t.Errorf("blob of burned upload kept")
+	}
+
+	// A blob shared with another upload outlives the burned upload.
+	kept := &models.UploadedFile{Uploader: "alice"}
+	burned = &models.UploadedFile{Uploader: "alice", BurnAfterReading: true}
+	for _, f := range []*models.UploadedFile{kept, burned} {
+		if err := app.saveText(ctx, f, "shared\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rc, err := app.openUpload(ctx, burned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if !blobExists(t, app, kept.Digest) {
+		t.Errorf("blob shared with a kept upload deleted")
+	}
+}
+
+func TestUpdateTitleAndDelete(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	f := &models.UploadedFile{Title: "before", Uploader: "alice"}
+	if err := app.saveText(ctx, f, "text\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.uploadedFiles.UpdateTitle(f.ID, "after"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := app.uploadedFiles.Get(f.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "after" {
+		t.Errorf("title = %q, want %q", got.Title, "after")
+	}
+
+	orphan, err := app.uploadedFiles.Delete(f.ID)
+	if err != nil || orphan != f.Digest {
+		t.Errorf("Delete() = %q, %v, want %q", orphan, err, f.Digest)
+	}
+	if _, err := app.uploadedFiles.Get(f.Slug); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("getting deleted upload: %v, want ErrNoRecord", err)
+	}
+	if err := app.uploadedFiles.UpdateTitle(f.ID, "again"); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("renaming deleted upload: %v, want ErrNoRecord", err)
+	}
+	if _, err := app.uploadedFiles.Delete(f.ID); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("deleting upload again: %v, want ErrNoRecord", err)
+	}
+}
+
+func TestAPIModifyUpload(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	s := httptest.NewServer(appRouter(app))
+	defer s.Close()
+
+	tokens := map[string]string{}
+	for username, role := range map[string]string{"alice": models.RoleUploader, "bob": models.RoleUploader, "carol": models.RoleAdmin} {
+		if _, err := app.users.Insert(username, "pw", role); err != nil {
+			t.Fatal(err)
+		}
+		token, err := app.apiTokens.Insert(username, "test", models.AllScopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[username] = token
+	}
+	f := &models.UploadedFile{Title: "mine", Uploader: "alice"}
+	if err := app.saveText(ctx, f, "text\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, method, body string
+		wantStatus         int
+		wantTitle          string
+	}{
+		{"bob", "PATCH", `{"title": "not yours"}`, http.StatusForbidden, "mine"},
+		{"alice", "PATCH", `{"title": " renamed "}`, http.StatusOK, "renamed"},
+		{"alice", "PATCH", `{}`, http.StatusBadRequest, "renamed"},
+		{"carol", "PATCH", `{"title": "by an admin"}`, http.StatusOK, "by an admin"},
+		{"bob", "DELETE", "", http.StatusForbidden, "by an admin"},
+		{"carol", "DELETE", "", http.StatusNoContent, ""},
+		{"alice", "DELETE", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, s.URL+"/api/v1/uploads/"+f.Slug, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+tokens[tt.user])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s by %s: status %d, want %d", tt.method, tt.user, resp.StatusCode, tt.wantStatus)
+		}
+		got, err := app.uploadedFiles.Get(f.Slug)
+		if tt.wantTitle == "" {
+			if !errors.Is(err, models.ErrNoRecord) {
+				t.Errorf("after %s by %s: upload still exists (%v)", tt.method, tt.user, err)
+			}
+		} else if err != nil {
+			t.Errorf("after %s by %s: getting upload: %v", tt.method, tt.user, err)
+		} else if got.Title != tt.wantTitle {
+			t.Errorf("after %s by %s: title %q, want %q", tt.method, tt.user, got.Title, tt.wantTitle)
+		}
+	}
+	if blobExists(t, app, f.Digest) {
+		t.Errorf("blob of deleted upload kept")
+	}
+}
+
+// failingStorage is a storage whose Put fails while fail is set.
+type failingStorage struct {
+	storage.Storage
+	fail bool
+}
+
+func (s *failingStorage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if s.fail {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(ctx, name, r, size)
+}
+
+func TestDeleteExpiredTusUploads(t *testing.T) {
+	app := newTestApp(t)
+	id := fmt.Sprintf("test-expired-%d", time.Now().UnixNano())
+	u := &models.TusUpload{ID: id, Uploader: "alice", Length: 10, Expires: time.Now().Add(-time.Minute)}
+	if err := app.tusUploads.Insert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(tusPath(id)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tusPath(id), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tusPath(id))
+
+	// Uploads being written to are left alone.
+	if !lockTusUpload(id) {
+		t.Fatal("upload is already locked")
+	}
+	if err := app.deleteExpiredTusUploads(); err != nil {
+		t.Fatal(err)
+	}
+	unlockTusUpload(id)
+	if ids, err := app.tusUploads.Expired(); err != nil || !slices.Contains(ids, id) {
+		t.Errorf("expired uploads after deleting them while locked = %q, %v, want %q", ids, err, id)
+	}
+	if _, err := os.Stat(tusPath(id)); err != nil {
+		t.Errorf("data of locked upload: %v", err)
+	}
+
+	if err := app.deleteExpiredTusUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := app.tusUploads.Expired(); err != nil || len(ids) != 0 {
+		t.Errorf("expired uploads after deleting them = %q, %v, want none", ids, err)
+	}
+	if _, err := os.Stat(tusPath(id)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("data of deleted upload: %v, want ErrNotExist", err)
+	}
+}
+
+func TestTusCompletionFailure(t *testing.T) {
+	app := newTestApp(t)
+	store := &failingStorage{Storage: app.storage}
+	app.storage = store
+	if _, err := app.users.Insert("alice", "pw", models.RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.apiTokens.Insert("alice", "test", models.AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(appRouter(app))
+	defer s.Close()
+
+	do := func(method, url string, header map[string]string, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	create := func(filename, data string) string {
+		t.Helper()
+		resp := do("POST", s.URL+"/tus/", map[string]string{
+			"Upload-Length":   strconv.Itoa(len(data)),
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+		}, "")
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /tus/: status %d", resp.StatusCode)
+		}
+		// Location is on the configured domain, rather than the test server.
+		location := resp.Header.Get("Location")
+		return s.URL + "/tus/" + location[strings.LastIndex(location, "/")+1:]
+	}
+	patch := func(url string, offset int, data string) *http.Response {
+		return do("PATCH", url, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, data)
+	}
+
+	// The last chunk is rolled back when storage fails, so that sending it
+	// again retries the completion.
+	url := create("notes.txt", "hello, world\n")
+	if resp := patch(url, 0, "hello, "); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("first PATCH: status %d", resp.StatusCode)
+	}
+	store.fail = true
+	if resp := patch(url, 7, "world\n"); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("last PATCH with failing storage: status %d, want 500", resp.StatusCode)
+	}
+	if got := do("HEAD", url, nil, "").Header.Get("Upload-Offset"); got != "7" {
+		t.Errorf("Upload-Offset after failure = %q, want 7", got)
+	}
+	store.fail = false
+	resp := patch(url, 7, "world\n")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Content-Location") == "" {
+		t.Errorf("retried PATCH: status %d, Content-Location %q", resp.StatusCode, resp.Header.Get("Content-Location"))
+	}
+
+	// Uploads that can't ever be completed are terminated.
+	url = create("photo.png", "not a PNG\n")
+	if resp := patch(url, 0, "not a PNG\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PATCH of mismatched contents: status %d, want 400", resp.StatusCode)
+	}
+	if resp := do("HEAD", url, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of terminated upload: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRawUploadBasicAuth(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.users.Insert("alice", "secret password", models.RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.apiTokens.Insert("alice", "test", models.AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(appRouter(app))
+	defer s.Close()
+
+	// Browsers resend credentials entered for basic auth with requests made
+	// by other sites, be they passwords or API tokens.
+	for i := 0; i < userLoginPolicy.lockoutFailures; i++ {
+		for _, password := range []string{"secret password", "wrong", token} {
+			req, _ := http.NewRequest("POST", s.URL+"/", strings.NewReader("text\n"))
+			req.SetBasicAuth("alice", password)
+			resp, err := s.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("POST / with basic auth: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+			}
+		}
+	}
+	// Passwords sent with basic auth aren't even checked.
+	if wait := app.logins.wait("127.0.0.1", "alice"); wait != 0 {
+		t.Errorf("after basic auth attempts, wait = %v, want 0", wait)
+	}
+
+	req, _ := http.NewRequest("POST", s.URL+"/", strings.NewReader("text\n"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST / with a bearer token: status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestAuthenticateUnknownUser(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.users.Insert("alice", "pw", models.RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	// The fastest of a few tries, to leave out pauses of the test itself.
+	fastest := func(username string) time.Duration {
+		var min time.Duration
+		for i := 0; i < 3; i++ {
+			start := time.Now()
+			if err := app.users.Authenticate(username, "wrong"); !errors.Is(err, models.ErrInvalidCredentials) {
+				t.Fatalf("Authenticate(%q) = %v, want ErrInvalidCredentials", username, err)
+			}
+			if d := time.Since(start); i == 0 || d < min {
+				min = d
+			}
+		}
+		return min
+	}
+	known, unknown := fastest("alice"), fastest("mallory")
+	if unknown < known/2 {
+		t.Errorf("unknown user rejected in %v, wrong password in %v; want about as long", unknown, known)
+	}
+}
+
+func TestEscapeTitles(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	s := httptest.NewServer(appRouter(app))
+	defer s.Close()
+
+	const title = `<script>alert("hi")</script>`
+	text := &models.UploadedFile{Title: title, Uploader: "alice", Language: markdownLanguage}
+	if err := app.saveText(ctx, text, "# Heading\n\n<script>alert(1)</script>\n"); err != nil {
+		t.Fatal(err)
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	image := &models.UploadedFile{Title: title, Uploader: "alice", Filename: "a.png"}
+	if err := app.saveUpload(ctx, image, &img, int64(img.Len())); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/t/" + text.Slug, "/u/" + image.Slug} {
+		r, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusOK {
+			t.Errorf("GET %s = %d, want %d", path, r.StatusCode, http.StatusOK)
+			continue
+		}
+		if strings.Contains(string(body), "<script>alert") {
+			t.Errorf("GET %s has an unescaped script:\n%s", path, body)
+		}
+		if !strings.Contains(string(body), "&lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt;") {
+			t.Errorf("GET %s doesn't have the escaped title", path)
+		}
+	}
+
+	// Rendered and highlighted texts are left as HTML.
+	r, err := http.Get(s.URL + "/t/" + text.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<h1>Heading</h1>", `<span class="ln" id="L1">`, ".chroma .ln:target"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("GET /t/%s doesn't have %q", text.Slug, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// plainText is the language of texts that aren't highlighted.
+const plainText = "plaintext"
+
+var highlightStyle = styles.Get("github")
+
+var highlightFormatter = html.New(
+	html.WithClasses(true),
+	html.WithLineNumbers(true),
+	html.WithLinkableLineNumbers(true, "L"),
+)
+
+// highlightCSS returns the stylesheet of highlighted texts.
+var highlightCSS = sync.OnceValue(func() string {
+	var css strings.Builder
+	if err := highlightFormatter.WriteCSS(&css, highlightStyle); err != nil {
+		panic(fmt.Sprintf("writing highlight CSS: %v", err))
+	}
+	return css.String()
+})
+
+// languages returns the names of the languages texts can be highlighted as,
+// sorted case-insensitively.
+func languages() []string {
+	return lexers.Names(false)
+}
+
+// parseLanguage returns the canonical name of a language chosen by the user.
+// An empty name is returned as is, meaning that the language is to be
+// guessed.
+func parseLanguage(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	lexer := lexers.Get(name)
+	if lexer == nil {
+		return "", fmt.Errorf("unknown language %q", name)
+	}
+	return lexer.Config().Name, nil
+}
+
+// guessLanguage guesses the language of a text from its filename, then from
+// its shebang line, then from the rest of its contents.
+func guessLanguage(filename, text string) string {
+	if lexer := lexers.Match(filename); lexer != nil && lexer.Config().Name != plainText {
+		return lexer.Config().Name
+	}
+	if lexer := lexers.Get(interpreter(text)); lexer != nil {
+		return lexer.Config().Name
+	}
+	if lexer := lexers.Analyse(text); lexer != nil {
+		return lexer.Config().Name
+	}
+	return plainText
+}
+
+// interpreter returns the name of the interpreter in the shebang line of a
+// script, e.g. "python3" for "#!/usr/bin/env python3".
+func interpreter(script string) string {
+	line, _, _ := strings.Cut(script, "\n")
+	line, ok := strings.CutPrefix(line, "#!")
+	if !ok {
+		return ""
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 && path.Base(fields[0]) == "env" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return path.Base(fields[0])
+}
+
+// highlight renders a text as HTML, highlighted as the given language, with
+// line numbers linking to #L1, #L2, etc.
+func highlight(language, text string) (string, error) {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return "", fmt.Errorf("tokenizing text: %v", err)
+	}
+	var b strings.Builder
+	if err := highlightFormatter.Format(&b, highlightStyle, tokens); err != nil {
+		return "", fmt.Errorf("formatting text: %v", err)
+	}
+	return b.String(), nil
+}
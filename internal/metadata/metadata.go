@@ -0,0 +1,567 @@
+// Package metadata strips metadata, such as where and with what camera a
+// photo was taken, from JPEG, PNG and WebP images. The image data itself is
+// copied as is, without decoding it.
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// An Image is an image read from a file, along with what must be left out of
+// it to strip its metadata.
+type Image struct {
+	r     io.ReadSeeker
+	parts []part
+	// Removed describes the metadata that is stripped from the image, e.g.
+	// "GPS location" or "XMP". It's empty if the image has no metadata to
+	// strip, or if it isn't in a supported format.
+	Removed []string
+}
+
+// part is a part of an image that is kept: either a range of the original
+// file, or data replacing it.
+type part struct {
+	offset, length int64
+	data           []byte
+}
+
+// errMalformed is wrapped by the errors returned for malformed images.
+var errMalformed = errors.New("malformed image")
+
+// Parse reads an image from r, finding the metadata to be stripped from it.
+// Files that aren't JPEG, PNG or WebP images are returned with nothing to
+// strip.
+func Parse(r io.ReadSeeker) (*Image, error) {
+	var magic [12]byte
+	n, err := io.ReadFull(r, magic[:])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img := &Image{r: r}
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte{0xff, 0xd8, 0xff}):
+		err = img.parseJPEG()
+	case bytes.HasPrefix(magic[:n], pngSignature):
+		err = img.parsePNG()
+	case n == 12 && string(magic[:4]) == "RIFF" && string(magic[8:]) == "WEBP":
+		err = img.parseWebP()
+	default:
+		// Copied as is.
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		img.keep(0, size)
+		return img, nil
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("%w: unexpected end of file", errMalformed)
+		}
+		return nil, err
+	}
+	return img, nil
+}
+
+// IsMalformed reports whether err was returned by Parse for a malformed
+// image.
+func IsMalformed(err error) bool {
+	return errors.Is(err, errMalformed)
+}
+
+// WriteTo writes the image without its metadata to w.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, p := range img.parts {
+		if p.data != nil {
+			n, err := w.Write(p.data)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		if _, err := img.r.Seek(p.offset, io.SeekStart); err != nil {
+			return written, err
+		}
+		n, err := io.CopyN(w, img.r, p.length)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// keep keeps length bytes of the original file, starting at offset.
+func (img *Image) keep(offset, length int64) {
+	if last := len(img.parts) - 1; last >= 0 && img.parts[last].data == nil && img.parts[last].offset+img.parts[last].length == offset {
+		img.parts[last].length += length
+		return
+	}
+	img.parts = append(img.parts, part{offset: offset, length: length})
+}
+
+// replace writes data in place of part of the original file.
+func (img *Image) replace(data []byte) {
+	img.parts = append(img.parts, part{data: data})
+}
+
+// remove records that some metadata was removed.
+func (img *Image) remove(what ...string) {
+	for _, s := range what {
+		if !slices.Contains(img.Removed, s) {
+			img.Removed = append(img.Removed, s)
+		}
+	}
+}
+
+// trailingData is the description of the data found after the end of an
+// image, such as the embedded pictures or videos that some cameras add.
+const trailingData = "data after the end of the image"
+
+// removeTrailingData removes whatever follows the end of the image, at
+// offset end.
+func (img *Image) removeTrailingData(end int64) error {
+	size, err := img.r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size > end {
+		img.remove(trailingData)
+	}
+	return nil
+}
+
+// JPEG
+
+// parseJPEG removes the APP1 (Exif and XMP), APP13 (IPTC) and comment
+// segments of a JPEG image, as well as the application segments that aren't
+// needed to display it. The orientation of the image is kept in a minimal
+// Exif segment.
+func (img *Image) parseJPEG() error {
+	r := &offsetReader{r: &byteReader{r: img.r}}
+	if _, err := r.next(2); err != nil {
+		return err
+	}
+	img.keep(0, 2)
+
+	for {
+		start := r.offset
+		marker, err := r.marker()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case marker == 0xd9: // EOI
+			img.keep(start, r.offset-start)
+			return img.removeTrailingData(r.offset)
+		case marker == 0x01 || 0xd0 <= marker && marker <= 0xd7: // TEM, RSTn
+			img.keep(start, r.offset-start)
+			continue
+		}
+
+		b, err := r.next(2)
+		if err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(b))
+		if length < 2 {
+			return fmt.Errorf("%w: JPEG segment of length %d", errMalformed, length)
+		}
+		data, err := r.next(length - 2)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case marker == 0xe1: // APP1
+			switch {
+			case bytes.HasPrefix(data, exifHeader):
+				fields, orientation := exifFields(data[len(exifHeader):])
+				img.remove(fields...)
+				if orientation > 1 {
+					img.replace(orientationSegment(orientation))
+				}
+			case bytes.HasPrefix(data, []byte("http://ns.adobe.com/xap/1.0/\x00")),
+				bytes.HasPrefix(data, []byte("http://ns.adobe.com/xmp/extension/\x00")):
+				img.remove("XMP")
+			default:
+				img.remove("APP1 segment")
+			}
+		case marker == 0xed: // APP13
+			img.remove("IPTC")
+		case marker == 0xfe: // COM
+			img.remove("comment")
+		case marker == 0xe0, marker == 0xe2, marker == 0xee:
+			// APP0 (JFIF), APP2 (ICC profile) and APP14 (Adobe color
+			// transform) are kept, as they affect how the image looks.
+			img.keep(start, r.offset-start)
+		case 0xe3 <= marker && marker <= 0xef: // Other APPn
+			img.remove(fmt.Sprintf("APP%d segment", marker-0xe0))
+		case marker == 0xda: // SOS
+			// The entropy-coded data follows, up to the next marker
+			// other than RSTn.
+			if err := r.skipEntropyCodedData(); errors.Is(err, io.EOF) {
+				// Truncated, but possibly still displayable.
+				img.keep(start, r.offset-start)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			img.keep(start, r.offset-start)
+		default:
+			img.keep(start, r.offset-start)
+		}
+	}
+}
+
+// offsetReader reads a JPEG image, keeping track of the offset in it.
+type offsetReader struct {
+	r      *byteReader
+	offset int64
+	buf    []byte
+	// peeked holds bytes that were read but not consumed.
+	peeked []byte
+}
+
+func (r *offsetReader) next(n int) ([]byte, error) {
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	b := r.buf[:n]
+	copied := copy(b, r.peeked)
+	r.peeked = r.peeked[copied:]
+	if _, err := io.ReadFull(r.r, b[copied:]); err != nil {
+		return nil, err
+	}
+	r.offset += int64(n)
+	return b, nil
+}
+
+func (r *offsetReader) readByte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// marker reads a marker, skipping any fill bytes before it.
+func (r *offsetReader) marker() (byte, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("%w: expected a JPEG marker at offset %d", errMalformed, r.offset-1)
+	}
+	for b == 0xff {
+		if b, err = r.readByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// skipEntropyCodedData reads up to the next marker that isn't RSTn, leaving
+// the marker unread.
+func (r *offsetReader) skipEntropyCodedData() error {
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		r.offset++
+		if b != 0xff {
+			continue
+		}
+		next, err := r.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		r.offset++
+		if next == 0x00 || 0xd0 <= next && next <= 0xd7 {
+			continue
+		}
+		// Unread the marker.
+		r.offset -= 2
+		r.peeked = append(r.peeked[:0], 0xff, next)
+		return nil
+	}
+}
+
+// byteReader buffers reads, so that bytes can be read one by one.
+type byteReader struct {
+	r   io.Reader
+	buf [32 << 10]byte
+	pos int
+	end int
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.pos == r.end {
+		n, err := r.r.Read(r.buf[:])
+		if n == 0 {
+			if err == nil {
+				err = io.ErrNoProgress
+			}
+			return 0, err
+		}
+		r.pos, r.end = 0, n
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if r.pos == r.end {
+		return r.r.Read(p)
+	}
+	n := copy(p, r.buf[r.pos:r.end])
+	r.pos += n
+	return n, nil
+}
+
+// PNG
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// parsePNG removes the text, Exif and modification time chunks of a PNG
+// image.
+func (img *Image) parsePNG() error {
+	offset := int64(len(pngSignature))
+	img.keep(0, offset)
+	if _, err := img.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(img.r, header[:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		chunkLength := 8 + length + 4 // header, data and CRC
+
+		switch chunkType {
+		case "tEXt", "zTXt", "iTXt":
+			keyword, err := readPNGKeyword(img.r, length)
+			if err != nil {
+				return err
+			}
+			img.remove(fmt.Sprintf("text (%s)", keyword))
+		case "eXIf":
+			data := make([]byte, min(length, maxExifSize))
+			if _, err := io.ReadFull(img.r, data); err != nil {
+				return err
+			}
+			fields, _ := exifFields(data)
+			img.remove(fields...)
+		case "tIME":
+			img.remove("modification time")
+		default:
+			img.keep(offset, chunkLength)
+		}
+
+		offset += chunkLength
+		if _, err := img.r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if chunkType == "IEND" {
+			return img.removeTrailingData(offset)
+		}
+	}
+}
+
+// readPNGKeyword reads the keyword starting the data of a PNG text chunk.
+func readPNGKeyword(r io.Reader, length int64) (string, error) {
+	data := make([]byte, min(length, 80))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	keyword, _, _ := bytes.Cut(data, []byte{0})
+	for _, c := range keyword {
+		if c < 0x20 || c > 0x7e {
+			return "unknown", nil
+		}
+	}
+	return string(keyword), nil
+}
+
+// WebP
+
+// VP8X flags telling which metadata chunks the image has.
+const (
+	vp8xExif = 0x08
+	vp8xXMP  = 0x04
+)
+
+// vp8xLength is the length of the data of VP8X chunks.
+const vp8xLength = 10
+
+// parseWebP removes the Exif and XMP chunks of a WebP image.
+func (img *Image) parseWebP() error {
+	var header [12]byte
+	if _, err := io.ReadFull(img.r, header[:]); err != nil {
+		return err
+	}
+	end := 8 + int64(binary.LittleEndian.Uint32(header[4:8]))
+	// The header is filled in once the size of the kept chunks is known.
+	img.replace(make([]byte, len(header)))
+	size := int64(4) // "WEBP"
+
+	offset := int64(len(header))
+	for offset < end {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(img.r, chunkHeader[:]); err != nil {
+			return err
+		}
+		fourCC := string(chunkHeader[:4])
+		length := int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+		chunkLength := 8 + length + length%2 // header, data and padding
+
+		switch fourCC {
+		case "EXIF":
+			data := make([]byte, min(length, maxExifSize))
+			if _, err := io.ReadFull(img.r, data); err != nil {
+				return err
+			}
+			fields, _ := exifFields(bytes.TrimPrefix(data, exifHeader))
+			img.remove(fields...)
+		case "XMP ":
+			img.remove("XMP")
+		case "VP8X":
+			// The chunk is copied to memory, so its length mustn't be
+			// trusted.
+			if length != vp8xLength {
+				return fmt.Errorf("%w: WebP VP8X chunk of length %d", errMalformed, length)
+			}
+			if offset+chunkLength > end {
+				return fmt.Errorf("%w: WebP chunk overruns the file", errMalformed)
+			}
+			chunk := make([]byte, chunkLength)
+			copy(chunk, chunkHeader[:])
+			if _, err := io.ReadFull(img.r, chunk[8:]); err != nil {
+				return err
+			}
+			chunk[8] &^= vp8xExif | vp8xXMP
+			img.replace(chunk)
+			size += chunkLength
+		default:
+			img.keep(offset, chunkLength)
+			size += chunkLength
+		}
+
+		offset += chunkLength
+		if _, err := img.r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if offset != end {
+		return fmt.Errorf("%w: WebP chunk overruns the file", errMalformed)
+	}
+
+	if len(img.Removed) == 0 {
+		// Nothing to strip, so keep the file exactly as it was.
+		img.parts = []part{{offset: 0, length: end}}
+	} else {
+		binary.LittleEndian.PutUint32(header[4:8], uint32(size))
+		copy(img.parts[0].data, header[:])
+	}
+	return img.removeTrailingData(end)
+}
+
+// Exif
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// maxExifSize is the size of the largest Exif metadata that is parsed.
+const maxExifSize = 1 << 20
+
+// exifTags are the Exif tags of the first IFD that are described in
+// Image.Removed.
+var exifTags = []struct {
+	tag  uint16
+	name string
+}{
+	{0x8825, "GPS location"},
+	{0x010f, "camera make"},
+	{0x0110, "camera model"},
+	{0x0132, "date and time"},
+	{0x013b, "artist"},
+	{0x8298, "copyright"},
+	{0x010e, "image description"},
+	{0x0131, "software"},
+	{0x8769, "camera settings"},
+}
+
+const exifOrientationTag = 0x0112
+
+// exifFields describes the fields of Exif metadata in TIFF format, and
+// returns the orientation of the image it describes (0 if unknown).
+func exifFields(tiff []byte) (fields []string, orientation int) {
+	fields = []string{"Exif"}
+	if len(tiff) < 8 {
+		return fields, 0
+	}
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return fields, 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return fields, 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	found := map[uint16]bool{}
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry:])
+		found[tag] = true
+		if tag == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 { // SHORT
+			orientation = int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	for _, t := range exifTags {
+		if found[t.tag] {
+			fields = append(fields, t.name)
+		}
+	}
+	return fields, orientation
+}
+
+// orientationSegment returns a JPEG APP1 segment with Exif metadata holding
+// only the given orientation.
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, '*', 0, 0, 0, 8, // header, with the IFD at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // orientation, 1 SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+	length := 2 + len(exifHeader) + len(tiff)
+	segment := []byte{0xff, 0xe1, byte(length >> 8), byte(length)}
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
@@ -0,0 +1,220 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"runtime"
+	"slices"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 100, 255})
+		}
+	}
+	return img
+}
+
+// testExif returns Exif metadata with a GPS location, a camera model and the
+// given orientation.
+func testExif(orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	for _, entry := range [][4]uint32{
+		{0x0110, 2, 4, binary.LittleEndian.Uint32([]byte("Pix\x00"))}, // camera model
+		{0x0112, 3, 1, uint32(orientation)},                           // orientation
+		{0x8825, 4, 1, 0},                                             // GPS IFD
+	} {
+		tiff = binary.LittleEndian.AppendUint16(tiff, uint16(entry[0]))
+		tiff = binary.LittleEndian.AppendUint16(tiff, uint16(entry[1]))
+		tiff = binary.LittleEndian.AppendUint32(tiff, entry[2])
+		tiff = binary.LittleEndian.AppendUint32(tiff, entry[3])
+	}
+	return binary.LittleEndian.AppendUint32(tiff, 0)
+}
+
+func jpegSegment(marker byte, data []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(data)))
+	return append(segment, data...)
+}
+
+func strip(t *testing.T, file []byte) (*Image, []byte) {
+	t.Helper()
+	img, err := Parse(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var b bytes.Buffer
+	if _, err := img.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	return img, b.Bytes()
+}
+
+func TestJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	var file []byte
+	file = append(file, encoded.Bytes()[:2]...) // SOI
+	file = append(file, jpegSegment(0xe1, append([]byte("Exif\x00\x00"), testExif(6)...))...)
+	file = append(file, jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))...)
+	file = append(file, jpegSegment(0xfe, []byte("shot on my phone"))...)
+	file = append(file, encoded.Bytes()[2:]...)
+	file = append(file, "trailing video"...)
+
+	img, stripped := strip(t, file)
+	want := []string{"Exif", "GPS location", "camera model", "XMP", "comment", trailingData}
+	if !slices.Equal(img.Removed, want) {
+		t.Errorf("img.Removed = %q, want %q", img.Removed, want)
+	}
+	wantFile := append(encoded.Bytes()[:2:2], orientationSegment(6)...)
+	wantFile = append(wantFile, encoded.Bytes()[2:]...)
+	if !bytes.Equal(stripped, wantFile) {
+		t.Errorf("stripped image differs from the original image with only its orientation")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("decoding stripped image: %v", err)
+	}
+	if fields, orientation := exifFields(orientationSegment(6)[10:]); orientation != 6 || len(fields) != 1 {
+		t.Errorf("exifFields(orientationSegment(6)) = %q, %d, want [Exif], 6", fields, orientation)
+	}
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestPNG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	iend := encoded.Len() - 12
+	var file []byte
+	file = append(file, encoded.Bytes()[:iend]...)
+	file = append(file, pngChunk("tEXt", []byte("Author\x00Jane Doe"))...)
+	file = append(file, pngChunk("eXIf", testExif(1))...)
+	file = append(file, encoded.Bytes()[iend:]...)
+
+	img, stripped := strip(t, file)
+	want := []string{"text (Author)", "Exif", "GPS location", "camera model"}
+	if !slices.Equal(img.Removed, want) {
+		t.Errorf("img.Removed = %q, want %q", img.Removed, want)
+	}
+	if !bytes.Equal(stripped, encoded.Bytes()) {
+		t.Errorf("stripped image differs from the original image")
+	}
+}
+
+// webpLossless is a 1x1 lossless WebP image.
+var webpLossless = []byte("VP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00")
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	file := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(file, body...)
+}
+
+func webpChunk(fourCC string, data []byte) []byte {
+	chunk := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestWebP(t *testing.T) {
+	vp8x := func(flags byte) []byte {
+		return webpChunk("VP8X", []byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	}
+	file := riff(vp8x(vp8xExif|vp8xXMP), webpLossless, webpChunk("EXIF", testExif(1)), webpChunk("XMP ", []byte("<x:xmpmeta/>")))
+
+	img, stripped := strip(t, file)
+	want := []string{"Exif", "GPS location", "camera model", "XMP"}
+	if !slices.Equal(img.Removed, want) {
+		t.Errorf("img.Removed = %q, want %q", img.Removed, want)
+	}
+	if want := riff(vp8x(0), webpLossless); !bytes.Equal(stripped, want) {
+		t.Errorf("stripped image = %q, want %q", stripped, want)
+	}
+	if _, err := webp.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("decoding stripped image: %v", err)
+	}
+}
+
+func TestNothingToStrip(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	for name, file := range map[string][]byte{
+		"png":  encoded.Bytes(),
+		"webp": riff(webpLossless),
+		"text": []byte("hello"),
+	} {
+		img, stripped := strip(t, file)
+		if len(img.Removed) != 0 {
+			t.Errorf("%s: img.Removed = %q, want none", name, img.Removed)
+		}
+		if !bytes.Equal(stripped, file) {
+			t.Errorf("%s: stripped file differs from the original", name)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for _, file := range [][]byte{
+		[]byte("\xff\xd8\xff\xe1\x00"),
+		append(pngSignature[:8:8], 0, 0, 0, 10, 'I', 'D'),
+		riff(webpChunk("VP8L", []byte("12345")))[:16],
+	} {
+		if _, err := Parse(bytes.NewReader(file)); !IsMalformed(err) {
+			t.Errorf("Parse(%q) error = %v, want a malformed image error", file, err)
+		}
+	}
+}
+
+func TestMalformedVP8X(t *testing.T) {
+	vp8x := webpChunk("VP8X", make([]byte, vp8xLength))
+	huge := slices.Clone(vp8x)
+	binary.LittleEndian.PutUint32(huge[4:], 0xfffffff0)
+	overrun := riff(vp8x)
+	binary.LittleEndian.PutUint32(overrun[4:], 4+8)
+
+	for name, file := range map[string][]byte{
+		"huge length":  riff(huge),
+		"short length": riff(webpChunk("VP8X", []byte{0})),
+		"overrunning":  overrun,
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := Parse(bytes.NewReader(file))
+		runtime.ReadMemStats(&after)
+		if !IsMalformed(err) {
+			t.Errorf("%s: Parse() error = %v, want a malformed image error", name, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: Parse() allocated %d bytes", name, allocated)
+		}
+	}
+}
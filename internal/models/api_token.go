@@ -0,0 +1,146 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes limit what an API token can be used for.
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeDelete = "delete"
+)
+
+// AllScopes are the scopes of a token with full access.
+var AllScopes = []string{ScopeRead, ScopeUpload, ScopeDelete}
+
+// TokenPrefix starts every API token, to make them easy to recognize, e.g.
+// by secret scanners.
+const TokenPrefix = "hermes_"
+
+type APIToken struct {
+	ID       int
+	Username string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	// LastUsed is the zero time if the token was never used.
+	LastUsed time.Time
+}
+
+// HasScope reports whether the token grants the given scope.
+func (t *APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+type APITokenModel struct {
+	DB *sql.DB
+}
+
+// hashToken returns the hash under which a token is stored. Tokens are long
+// random strings, so a plain SHA-256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Insert generates a new API token for a user. The token itself is only
+// returned here; the database keeps just its hash.
+func (m *APITokenModel) Insert(username, name string, scopes []string) (string, error) {
+	if m.DB == nil {
+		return "", nil
+	}
+
+	for _, s := range scopes {
+		if !slices.Contains(AllScopes, s) {
+			return "", fmt.Errorf("invalid scope %q", s)
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("generating token: %v", err)
+	}
+	token := TokenPrefix + hex.EncodeToString(secret)
+
+	_, err := m.DB.Exec(`INSERT INTO api_tokens(username, name, hash, scopes, created_at) VALUES(?, ?, ?, ?, datetime('now'))`,
+		username, name, hashToken(token), strings.Join(scopes, " "))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+const apiTokenColumns = `id, username, name, scopes, created_at, last_used_at`
+
+func scanAPIToken(row scanner) (*APIToken, error) {
+	t := &APIToken{}
+	var scopes string
+	var lastUsed sql.NullTime
+	err := row.Scan(&t.ID, &t.Username, &t.Name, &scopes, &t.Created, &lastUsed)
+	t.Scopes = strings.Fields(scopes)
+	t.LastUsed = lastUsed.Time
+	return t, err
+}
+
+// List the API tokens of a user, newest first.
+func (m *APITokenModel) List(username string) ([]*APIToken, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	rows, err := m.DB.Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE username = ? ORDER BY created_at DESC, id DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Delete (revoke) an API token of a user.
+func (m *APITokenModel) Delete(username string, id int) error {
+	if m.DB == nil {
+		return ErrNoRecord
+	}
+
+	result, err := m.DB.Exec(`DELETE FROM api_tokens WHERE username = ? AND id = ?`, username, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// Authenticate returns the API token matching token, and records that it was
+// used.
+func (m *APITokenModel) Authenticate(token string) (*APIToken, error) {
+	if m.DB == nil || !strings.HasPrefix(token, TokenPrefix) {
+		return nil, ErrInvalidCredentials
+	}
+
+	t, err := scanAPIToken(m.DB.QueryRow(`UPDATE api_tokens SET last_used_at = datetime('now') WHERE hash = ? AND username NOT IN (SELECT username FROM users WHERE disabled) RETURNING `+apiTokenColumns, hashToken(token)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
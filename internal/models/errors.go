@@ -1,5 +1,15 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
-var ErrNoRecord = errors.New("models: no matching record found")
+var (
+	ErrNoRecord           = errors.New("models: no matching record found")
+	ErrDuplicateUsername  = errors.New("models: username already taken")
+	ErrInvalidCredentials = errors.New("models: invalid username or password")
+	// ErrUserDisabled is returned for the right credentials of a disabled
+	// user, which are as good as invalid.
+	ErrUserDisabled = fmt.Errorf("%w: user is disabled", ErrInvalidCredentials)
+)
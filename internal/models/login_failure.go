@@ -0,0 +1,84 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LoginFailures counts the failed logins of a client, e.g. of an IP address
+// or for a username.
+type LoginFailures struct {
+	Key   string
+	Count int
+	Last  time.Time
+	// LockedUntil is when the client may try to log in again.
+	LockedUntil time.Time
+}
+
+// LoginFailureModel persists the failed logins counted in memory, so that
+// they survive restarts.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// List the failed logins of the clients that failed to log in since the
+// given time.
+func (m *LoginFailureModel) List(since time.Time) ([]*LoginFailures, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	rows, err := m.DB.Query(`SELECT key, count, last_failure_at, locked_until FROM login_failures WHERE last_failure_at > ?`, sqlTime(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []*LoginFailures
+	for rows.Next() {
+		f := &LoginFailures{}
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&f.Key, &f.Count, &f.Last, &lockedUntil); err != nil {
+			return nil, err
+		}
+		f.LockedUntil = lockedUntil.Time
+		failures = append(failures, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// Save the failed logins of a client.
+func (m *LoginFailureModel) Save(f *LoginFailures) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	_, err := m.DB.Exec(`INSERT INTO login_failures(key, count, last_failure_at, locked_until) VALUES(?, ?, ?, ?)
+ON CONFLICT(key) DO UPDATE SET count = excluded.count, last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+		f.Key, f.Count, sqlTime(f.Last), sqlTime(f.LockedUntil))
+	return err
+}
+
+// Delete the failed logins of a client.
+func (m *LoginFailureModel) Delete(key string) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	_, err := m.DB.Exec(`DELETE FROM login_failures WHERE key = ?`, key)
+	return err
+}
+
+// DeleteBefore deletes the failed logins of the clients that last failed to
+// log in before the given time.
+func (m *LoginFailureModel) DeleteBefore(t time.Time) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	_, err := m.DB.Exec(`DELETE FROM login_failures WHERE last_failure_at <= ?`, sqlTime(t))
+	return err
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SessionModel stores the sessions of scs in the database, so that they
+// survive restarts. Sessions are kept along with the user they're logged in
+// as, if any, so that the sessions of a user can be found without decoding
+// every session.
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// Find the data of a session that hasn't expired.
+func (m *SessionModel) Find(token string) ([]byte, bool, error) {
+	if m.DB == nil {
+		return nil, false, nil
+	}
+
+	var data []byte
+	err := m.DB.QueryRow(`SELECT data FROM sessions WHERE token = ? AND expires_at > datetime('now')`, token).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Save the data of a session logged in as username, or anonymous if it's
+// empty, replacing it if the session exists.
+func (m *SessionModel) Save(token, username string, data []byte, expires time.Time) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	_, err := m.DB.Exec(`INSERT INTO sessions(token, username, data, expires_at) VALUES(?, ?, ?, ?)
+ON CONFLICT(token) DO UPDATE SET username = excluded.username, data = excluded.data, expires_at = excluded.expires_at`,
+		token, username, data, sqlTime(expires))
+	return err
+}
+
+// Delete a session.
+func (m *SessionModel) Delete(token string) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	_, err := m.DB.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+	return err
+}
+
+// OfUser returns the data of every session logged in as username that
+// hasn't expired, by token.
+func (m *SessionModel) OfUser(username string) (map[string][]byte, error) {
+	sessions := map[string][]byte{}
+	if m.DB == nil {
+		return sessions, nil
+	}
+
+	rows, err := m.DB.Query(`SELECT token, data FROM sessions WHERE username = ? AND expires_at > datetime('now')`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		var data []byte
+		if err := rows.Scan(&token, &data); err != nil {
+			return nil, err
+		}
+		sessions[token] = data
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteExpired deletes the sessions that have expired.
+func (m *SessionModel) DeleteExpired() error {
+	if m.DB == nil {
+		return nil
+	}
+
+	_, err := m.DB.Exec(`DELETE FROM sessions WHERE expires_at <= datetime('now')`)
+	return err
+}
@@ -0,0 +1,80 @@
+package models
+
+import "fmt"
+
+// Stats describe the uploads of a hermes instance.
+type Stats struct {
+	Files int
+	// BlobBytes is the size of the contents of all files. Files with the
+	// same contents share a blob, which is counted once.
+	BlobBytes int64
+	// UploadsPerDay are the number of files uploaded on each of the last
+	// days, oldest first. Days without uploads are left out.
+	UploadsPerDay []DayCount
+	// TopUploaders are the users who uploaded the most files, most first.
+	TopUploaders []UploaderStats
+}
+
+type DayCount struct {
+	// Day is the date, as YYYY-MM-DD.
+	Day   string
+	Count int
+}
+
+type UploaderStats struct {
+	Uploader string
+	Files    int
+	Bytes    int64
+}
+
+// Stats returns the stats of the uploaded files, with the uploads of the
+// last days and the top uploaders.
+func (m *UploadedFileModel) Stats(days, topUploaders int) (*Stats, error) {
+	s := &Stats{}
+	if m.DB == nil {
+		return s, nil
+	}
+
+	err := m.DB.QueryRow(`SELECT count(*) FROM uploaded_files`).Scan(&s.Files)
+	if err != nil {
+		return nil, err
+	}
+	err = m.DB.QueryRow(`SELECT coalesce(sum(size), 0) FROM blobs`).Scan(&s.BlobBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.Query(`SELECT date(created_at), count(*) FROM uploaded_files WHERE created_at >= date('now', ?) GROUP BY 1 ORDER BY 1`,
+		fmt.Sprintf("-%d days", days-1))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DayCount
+		if err := rows.Scan(&d.Day, &d.Count); err != nil {
+			return nil, err
+		}
+		s.UploadsPerDay = append(s.UploadsPerDay, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.Query(`SELECT f.uploader, count(*), sum(b.size) FROM `+uploadedFileTables+` GROUP BY f.uploader ORDER BY 2 DESC, 3 DESC LIMIT ?`, topUploaders)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u UploaderStats
+		if err := rows.Scan(&u.Uploader, &u.Files, &u.Bytes); err != nil {
+			return nil, err
+		}
+		s.TopUploaders = append(s.TopUploaders, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+// recoveryCodeCount is how many recovery codes users get, each of which can
+// be used once instead of a TOTP code.
+const recoveryCodeCount = 10
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode strips a recovery code of what users may add or
+// change when typing it.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// TOTP returns the TOTP secret of a user, and the last time step a code was
+// used for. The secret is empty if the user hasn't enabled TOTP.
+func (m *UserModel) TOTP(username string) (secret string, lastStep int64, err error) {
+	if m.DB == nil {
+		return "", 0, nil
+	}
+
+	err = m.DB.QueryRow(`SELECT totp_secret, totp_last_step FROM users WHERE username = ?`, username).Scan(&secret, &lastStep)
+	return secret, lastStep, err
+}
+
+// EnableTOTP enables TOTP for a user, the code of the given time step having
+// been used to confirm it. It returns the user's new recovery codes.
+func (m *UserModel) EnableTOTP(username, secret string, step int64) ([]string, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = ? WHERE username = ?`, secret, step, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectAffected(result); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTOTP disables TOTP for a user, deleting their recovery codes.
+func (m *UserModel) DisableTOTP(username string) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE users SET totp_secret = '', totp_last_step = 0 WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(result); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ?`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a user logged in with the code of a time step.
+// It returns ErrInvalidCredentials if a code of that time step or a later
+// one was already used, so that codes can't be replayed.
+func (m *UserModel) UseTOTPStep(username string, step int64) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	result, err := m.DB.Exec(`UPDATE users SET totp_last_step = ? WHERE username = ? AND totp_last_step < ?`, step, username, step)
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(result); err == ErrNoRecord {
+		return ErrInvalidCredentials
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up one of the recovery codes of a user. It returns
+// ErrInvalidCredentials if the user has no such code.
+func (m *UserModel) UseRecoveryCode(username, code string) error {
+	if m.DB == nil {
+		return ErrInvalidCredentials
+	}
+
+	result, err := m.DB.Exec(`DELETE FROM recovery_codes WHERE username = ? AND hash = ?`, username, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(result); err == ErrNoRecord {
+		return ErrInvalidCredentials
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes a user has.
+func (m *UserModel) RecoveryCodesLeft(username string) (int, error) {
+	if m.DB == nil {
+		return 0, nil
+	}
+
+	var n int
+	err := m.DB.QueryRow(`SELECT count(*) FROM recovery_codes WHERE username = ?`, username).Scan(&n)
+	return n, err
+}
+
+// NewRecoveryCodes replaces the recovery codes of a user with new ones, and
+// returns them. Like API tokens, only their hashes are stored.
+func (m *UserModel) NewRecoveryCodes(username string) ([]string, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, username string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generating recovery code: %v", err)
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		_, err := tx.Exec(`INSERT INTO recovery_codes(username, hash) VALUES(?, ?)`, username, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TusUpload is a resumable upload made through the tus protocol. Its data is
+// kept apart from the blobs until it's complete, when it becomes an
+// UploadedFile.
+type TusUpload struct {
+	ID       string
+	Uploader string
+	// Length is the total size of the upload in bytes.
+	Length int64
+	// Metadata is the Upload-Metadata header sent when the upload was
+	// created, as is.
+	Metadata string
+	// Slug is the slug of the uploaded file, or empty if the upload isn't
+	// complete yet.
+	Slug    string
+	Created time.Time
+	Expires time.Time
+}
+
+type TusUploadModel struct {
+	DB *sql.DB
+}
+
+const tusUploadColumns = `id, uploader, length, metadata, slug, created_at, expires_at`
+
+func scanTusUpload(row scanner) (*TusUpload, error) {
+	u := &TusUpload{}
+	var slug sql.NullString
+	err := row.Scan(&u.ID, &u.Uploader, &u.Length, &u.Metadata, &slug, &u.Created, &u.Expires)
+	u.Slug = slug.String
+	return u, err
+}
+
+// Insert a new tus upload. Its creation time is filled in.
+func (m *TusUploadModel) Insert(u *TusUpload) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	return m.DB.QueryRow(`INSERT INTO tus_uploads(id, uploader, length, metadata, created_at, expires_at) VALUES(?, ?, ?, ?, datetime('now'), ?) RETURNING created_at`,
+		u.ID, u.Uploader, u.Length, u.Metadata, sqlTime(u.Expires)).Scan(&u.Created)
+}
+
+// Get a tus upload that hasn't expired.
+func (m *TusUploadModel) Get(id string) (*TusUpload, error) {
+	if m.DB == nil {
+		return nil, ErrNoRecord
+	}
+
+	u, err := scanTusUpload(m.DB.QueryRow(`SELECT `+tusUploadColumns+` FROM tus_uploads WHERE id = ? AND expires_at > datetime('now')`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Complete marks a tus upload as complete, recording the slug of the
+// uploaded file it became.
+func (m *TusUploadModel) Complete(id, slug string) error {
+	if m.DB == nil {
+		return ErrNoRecord
+	}
+
+	result, err := m.DB.Exec(`UPDATE tus_uploads SET slug = ? WHERE id = ?`, slug, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// Delete a tus upload.
+func (m *TusUploadModel) Delete(id string) error {
+	if m.DB == nil {
+		return ErrNoRecord
+	}
+
+	result, err := m.DB.Exec(`DELETE FROM tus_uploads WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// Expired returns the IDs of the tus uploads that have expired.
+func (m *TusUploadModel) Expired() ([]string, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	rows, err := m.DB.Query(`SELECT id FROM tus_uploads WHERE expires_at <= datetime('now')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -10,68 +10,173 @@ import (
 	"time"
 )
 
+// Visibilities of uploaded files.
+const (
+	// VisibilityPublic files are listed, and anyone can see them.
+	VisibilityPublic = "public"
+	// VisibilityUnlisted files aren't listed, but anyone with their link
+	// can see them.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPrivate files can only be seen by their uploader.
+	VisibilityPrivate = "private"
+)
+
+// Visibilities are the visibilities uploaded files can have.
+var Visibilities = []string{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate}
+
 type UploadedFile struct {
-	ID       int
+	ID int
+	// Slug is the random identifier used in the URLs of the file.
+	Slug     string
 	Title    string
 	Uploader string
-	FilePath string
+	// Filename is the name the file was uploaded with. Its contents are
+	// stored in a blob named by Digest.
+	Filename string
+	// MIMEType is the media type of the file, detected from its contents
+	// when it was uploaded.
+	MIMEType string
+	Digest   string
+	Size     int64
 	Created  time.Time
+	// Expires is when the file stops being available. The zero time means
+	// it never expires.
+	Expires time.Time
+	// BurnAfterReading files are deleted the first time they're read.
+	BurnAfterReading bool
+	// Language is the name of the language text files are highlighted as.
+	// If empty, it's guessed when the file is shown.
+	Language string
+	// StrippedMetadata describes the metadata removed from uploaded images.
+	StrippedMetadata []string
+	// Visibility is who can see the file. If empty when inserted, the file
+	// is public.
+	Visibility string
 }
 
-func (f *UploadedFile) MIMEType() string {
-	return mime.TypeByExtension(filepath.Ext(f.FilePath))
+func init() {
+	// Not every system knows Markdown files, which are shown as text.
+	mime.AddExtensionType(".md", "text/markdown; charset=utf-8")
+	mime.AddExtensionType(".markdown", "text/markdown; charset=utf-8")
 }
 
+// Type returns the top-level media type of the file, e.g. "image".
 func (f *UploadedFile) Type() string {
-	return strings.Split(f.MIMEType(), "/")[0]
+	mimeType := f.MIMEType
+	if mimeType == "" {
+		// Not detected yet, as the file is still being uploaded.
+		mimeType = mime.TypeByExtension(filepath.Ext(f.Filename))
+	}
+	return strings.Split(mimeType, "/")[0]
 }
 
 func (f *UploadedFile) FileHref() string {
 	if f.Type() == "text" {
-		return fmt.Sprintf("/t/%d", f.ID)
+		return fmt.Sprintf("/t/%s", f.Slug)
 	} else {
-		return fmt.Sprintf("/u/%d", f.ID)
+		return fmt.Sprintf("/u/%s", f.Slug)
 	}
 }
 
 func (f *UploadedFile) RawFileHref() string {
-	return fmt.Sprintf("/dl/%d", f.ID)
+	return fmt.Sprintf("/dl/%s", f.Slug)
 }
 
 type UploadedFileModel struct {
 	DB *sql.DB
 }
 
-// Insert a new uploaded file.
-func (m *UploadedFileModel) Insert(title, uploader, path string) (int, error) {
+// uploadedFileColumns are the columns scanned by scanUploadedFile.
+const uploadedFileColumns = `f.id, f.slug, f.title, f.uploader, f.filename, f.mime_type, f.digest, b.size, f.created_at, f.expires_at, f.burn_after_reading, f.language, f.stripped_metadata, f.visibility`
+
+// uploadedFileTables joins uploaded files with the blobs holding their
+// contents.
+const uploadedFileTables = `uploaded_files f JOIN blobs b ON b.digest = f.digest`
+
+// notExpired is the condition matching uploaded files that haven't expired.
+const notExpired = `(f.expires_at IS NULL OR f.expires_at > datetime('now'))`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUploadedFile(row scanner) (*UploadedFile, error) {
+	f := &UploadedFile{}
+	var expires sql.NullTime
+	var strippedMetadata string
+	err := row.Scan(&f.ID, &f.Slug, &f.Title, &f.Uploader, &f.Filename, &f.MIMEType, &f.Digest, &f.Size, &f.Created, &expires, &f.BurnAfterReading, &f.Language, &strippedMetadata, &f.Visibility)
+	f.Expires = expires.Time
+	if strippedMetadata != "" {
+		f.StrippedMetadata = strings.Split(strippedMetadata, ",")
+	}
+	return f, err
+}
+
+// sqlTime formats t the way SQLite's datetime() does, so that it can be
+// compared with it. The zero time is stored as NULL.
+func sqlTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.DateTime)
+}
+
+// Insert a new uploaded file, taking a reference to the blob holding its
+// contents. The ID and creation time of f are filled in.
+func (m *UploadedFileModel) Insert(f *UploadedFile) error {
 	if m.DB == nil {
-		return 0, nil
+		return nil
 	}
 
-	stmt, err := m.DB.Prepare(`INSERT INTO uploaded_files(title, uploader, file_path, created_at) VALUES(?, ?, ?, datetime('now'))`)
+	tx, err := m.DB.Begin()
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO blobs(digest, size, refcount) VALUES(?, ?, 1)
+		ON CONFLICT(digest) DO UPDATE SET refcount = refcount + 1`, f.Digest, f.Size)
+	if err != nil {
+		return err
+	}
+	if f.Visibility == "" {
+		f.Visibility = VisibilityPublic
 	}
-	defer stmt.Close()
-	result, err := stmt.Exec(title, uploader, path)
+	result, err := tx.Exec(`INSERT INTO uploaded_files(slug, title, uploader, filename, mime_type, digest, created_at, expires_at, burn_after_reading, language, stripped_metadata, visibility) VALUES(?, ?, ?, ?, ?, ?, datetime('now'), ?, ?, ?, ?, ?)`,
+		f.Slug, f.Title, f.Uploader, f.Filename, f.MIMEType, f.Digest, sqlTime(f.Expires), f.BurnAfterReading, f.Language, strings.Join(f.StrippedMetadata, ","), f.Visibility)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	id, err := result.LastInsertId()
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return int(id), nil
+	err = tx.QueryRow(`SELECT created_at FROM uploaded_files WHERE id = ?`, id).Scan(&f.Created)
+	if err != nil {
+		return err
+	}
+	f.ID = int(id)
+	return tx.Commit()
+}
+
+// Get uploaded file by slug.
+func (m *UploadedFileModel) Get(slug string) (*UploadedFile, error) {
+	return m.getWhere(`f.slug = ?`, slug)
+}
+
+// GetByLegacyID gets an uploaded file by ID. Only files uploaded before
+// slugs were introduced can be found by ID, so that newer uploads can't be
+// enumerated.
+func (m *UploadedFileModel) GetByLegacyID(id int) (*UploadedFile, error) {
+	return m.getWhere(`f.id = ? AND f.legacy`, id)
 }
 
-// Get uploaded file by ID.
-func (m *UploadedFileModel) Get(id int) (*UploadedFile, error) {
+func (m *UploadedFileModel) getWhere(cond string, args ...any) (*UploadedFile, error) {
 	if m.DB == nil {
-		return nil, nil
+		return nil, ErrNoRecord
 	}
 
-	f := &UploadedFile{}
-	err := m.DB.QueryRow(`SELECT id, title, uploader, file_path, created_at FROM uploaded_files WHERE id = ?`, id).Scan(&f.ID, &f.Title, &f.Uploader, &f.FilePath, &f.Created)
+	f, err := scanUploadedFile(m.DB.QueryRow(`SELECT `+uploadedFileColumns+` FROM `+uploadedFileTables+` WHERE `+notExpired+` AND `+cond, args...))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -82,13 +187,14 @@ func (m *UploadedFileModel) Get(id int) (*UploadedFile, error) {
 	return f, nil
 }
 
-// Return the 10 latest uploaded files.
+// Return the 10 latest public uploaded files. Files to be burned after
+// reading aren't listed, since showing them would burn them.
 func (m *UploadedFileModel) Latest() ([]*UploadedFile, error) {
 	if m.DB == nil {
 		return nil, nil
 	}
 
-	rows, err := m.DB.Query(`SELECT id, title, uploader, file_path, created_at FROM uploaded_files ORDER BY created_at DESC LIMIT 10`)
+	rows, err := m.DB.Query(`SELECT ` + uploadedFileColumns + ` FROM ` + uploadedFileTables + ` WHERE ` + notExpired + ` AND NOT f.burn_after_reading AND f.visibility = '` + VisibilityPublic + `' ORDER BY f.created_at DESC LIMIT 10`)
 	if err != nil {
 		return nil, err
 	}
@@ -96,8 +202,8 @@ func (m *UploadedFileModel) Latest() ([]*UploadedFile, error) {
 
 	latest := []*UploadedFile{}
 	for rows.Next() {
-		f := &UploadedFile{}
-		if err := rows.Scan(&f.ID, &f.Title, &f.Uploader, &f.FilePath, &f.Created); err != nil {
+		f, err := scanUploadedFile(rows)
+		if err != nil {
 			return nil, err
 		}
 		latest = append(latest, f)
@@ -107,3 +213,199 @@ func (m *UploadedFileModel) Latest() ([]*UploadedFile, error) {
 	}
 	return latest, nil
 }
+
+// UploadedFileFilter selects uploaded files in List. Zero fields match any
+// file.
+type UploadedFileFilter struct {
+	Uploader string
+	// Type is the top-level media type of the files, e.g. "image".
+	Type string
+	// Since and Until bound when the files were uploaded.
+	Since, Until time.Time
+	// MinSize and MaxSize bound the size of the files, in bytes.
+	MinSize, MaxSize int64
+	// IncludeBurnAfterReading also matches the files to be burned after
+	// reading, which are otherwise left out.
+	IncludeBurnAfterReading bool
+	// Only public files match, and the files of Viewer if it's set, unless
+	// AllVisibilities is set.
+	Viewer          string
+	AllVisibilities bool
+}
+
+// where returns the SQL condition matching the filter, and its arguments.
+func (filter UploadedFileFilter) where() (string, []any) {
+	conds := []string{notExpired}
+	var args []any
+	if !filter.IncludeBurnAfterReading {
+		conds = append(conds, `NOT f.burn_after_reading`)
+	}
+	if !filter.AllVisibilities {
+		conds = append(conds, `(f.visibility = ? OR f.uploader = ?)`)
+		args = append(args, VisibilityPublic, filter.Viewer)
+	}
+	if filter.Uploader != "" {
+		conds = append(conds, `f.uploader = ?`)
+		args = append(args, filter.Uploader)
+	}
+	if filter.Type != "" {
+		conds = append(conds, `f.mime_type LIKE ?`)
+		args = append(args, filter.Type+"/%")
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, `f.created_at >= ?`)
+		args = append(args, sqlTime(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, `f.created_at < ?`)
+		args = append(args, sqlTime(filter.Until))
+	}
+	if filter.MinSize != 0 {
+		conds = append(conds, `b.size >= ?`)
+		args = append(args, filter.MinSize)
+	}
+	if filter.MaxSize != 0 {
+		conds = append(conds, `b.size <= ?`)
+		args = append(args, filter.MaxSize)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// List returns the uploaded files matching filter, newest first, skipping
+// the first offset files and returning at most limit. The total number of
+// matching files is also returned. Files to be burned after reading aren't
+// listed.
+func (m *UploadedFileModel) List(filter UploadedFileFilter, limit, offset int) ([]*UploadedFile, int, error) {
+	if m.DB == nil {
+		return nil, 0, nil
+	}
+
+	where, args := filter.where()
+	var total int
+	err := m.DB.QueryRow(`SELECT count(*) FROM `+uploadedFileTables+` WHERE `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := m.DB.Query(`SELECT `+uploadedFileColumns+` FROM `+uploadedFileTables+` WHERE `+where+` ORDER BY f.created_at DESC, f.id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	files := []*UploadedFile{}
+	for rows.Next() {
+		f, err := scanUploadedFile(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
+
+// UpdateTitle changes the title of an uploaded file.
+func (m *UploadedFileModel) UpdateTitle(id int, title string) error {
+	if m.DB == nil {
+		return ErrNoRecord
+	}
+
+	result, err := m.DB.Exec(`UPDATE uploaded_files SET title = ? WHERE id = ?`, title, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// Delete an uploaded file by ID, dropping its reference to its blob. If no
+// other file references the blob, its digest is returned so that it can be
+// removed from storage.
+func (m *UploadedFileModel) Delete(id int) (orphan string, err error) {
+	if m.DB == nil {
+		return "", ErrNoRecord
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	orphan, err = deleteUploadedFile(tx, id)
+	if err != nil {
+		return "", err
+	}
+	return orphan, tx.Commit()
+}
+
+// DeleteExpired deletes all expired uploaded files. It returns the number
+// of files deleted and the digests of the blobs no longer referenced.
+func (m *UploadedFileModel) DeleteExpired() (n int, orphans []string, err error) {
+	if m.DB == nil {
+		return 0, nil, nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM uploaded_files WHERE expires_at <= datetime('now')`)
+	if err != nil {
+		return 0, nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	for _, id := range ids {
+		orphan, err := deleteUploadedFile(tx, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if orphan != "" {
+			orphans = append(orphans, orphan)
+		}
+	}
+	return len(ids), orphans, tx.Commit()
+}
+
+// deleteUploadedFile deletes an uploaded file and drops its reference to its
+// blob, returning the digest of the blob if it's no longer referenced.
+func deleteUploadedFile(tx *sql.Tx, id int) (string, error) {
+	var digest string
+	err := tx.QueryRow(`DELETE FROM uploaded_files WHERE id = ? RETURNING digest`, id).Scan(&digest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoRecord
+	} else if err != nil {
+		return "", err
+	}
+
+	var refcount int
+	err = tx.QueryRow(`UPDATE blobs SET refcount = refcount - 1 WHERE digest = ? RETURNING refcount`, digest).Scan(&refcount)
+	if err != nil {
+		return "", err
+	}
+	if refcount > 0 {
+		return "", nil
+	}
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE digest = ?`, digest); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
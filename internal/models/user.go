@@ -0,0 +1,271 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters used to hash user passwords. Changing these
+// invalidates every stored hash.
+const (
+	argon2Time    = 1
+	argon2Memory  = 60 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	saltLen       = 16
+)
+
+// Roles tell what users may do. Each role may do everything the ones before
+// it may.
+const (
+	// RoleViewer may log in, but not upload.
+	RoleViewer = "viewer"
+	// RoleUploader may upload, and delete their own uploads.
+	RoleUploader = "uploader"
+	// RoleAdmin may also delete the uploads of others, and manage users.
+	RoleAdmin = "admin"
+)
+
+// Roles are all the roles, from the least to the most privileged.
+var Roles = []string{RoleViewer, RoleUploader, RoleAdmin}
+
+type User struct {
+	ID       int
+	Username string
+	Role     string
+	// Disabled users can't log in, nor use their API tokens.
+	Disabled bool
+}
+
+type UserModel struct {
+	DB *sql.DB
+}
+
+// dummySalt is hashed with the passwords of unknown users.
+var dummySalt = make([]byte, saltLen)
+
+// hashPassword computes the Argon2id key of password with the given salt.
+func hashPassword(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+}
+
+// newSaltAndHash generates a random salt and hashes password with it. Both
+// are returned hex-encoded, as they're stored in the users table.
+func newSaltAndHash(password string) (string, string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", "", fmt.Errorf("generating salt: %v", err)
+	}
+	return hex.EncodeToString(salt), hex.EncodeToString(hashPassword(password, salt)), nil
+}
+
+// Insert a new user with the given password and role.
+func (m *UserModel) Insert(username, password, role string) (int, error) {
+	if m.DB == nil {
+		return 0, nil
+	}
+
+	if !slices.Contains(Roles, role) {
+		return 0, fmt.Errorf("invalid role %q", role)
+	}
+	salt, hash, err := newSaltAndHash(password)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, username).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrDuplicateUsername
+	}
+	result, err := tx.Exec(`INSERT INTO users(username, salt, hash, role) VALUES(?, ?, ?, ?)`, username, salt, hash, role)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// SetPassword replaces the password of an existing user.
+func (m *UserModel) SetPassword(username, password string) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	salt, hash, err := newSaltAndHash(password)
+	if err != nil {
+		return err
+	}
+	result, err := m.DB.Exec(`UPDATE users SET salt = ?, hash = ? WHERE username = ?`, salt, hash, username)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// Role returns the role of a user.
+func (m *UserModel) Role(username string) (string, error) {
+	if m.DB == nil {
+		return "", ErrNoRecord
+	}
+
+	var role string
+	err := m.DB.QueryRow(`SELECT role FROM users WHERE username = ?`, username).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoRecord
+	}
+	return role, err
+}
+
+// SetRole changes the role of an existing user.
+func (m *UserModel) SetRole(username, role string) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	if !slices.Contains(Roles, role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	result, err := m.DB.Exec(`UPDATE users SET role = ? WHERE username = ?`, role, username)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// SetDisabled disables or enables an existing user.
+func (m *UserModel) SetDisabled(username string, disabled bool) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	result, err := m.DB.Exec(`UPDATE users SET disabled = ? WHERE username = ?`, disabled, username)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// Delete a user by username, along with their API tokens and recovery
+// codes.
+func (m *UserModel) Delete(username string) error {
+	if m.DB == nil {
+		return nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM users WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(result); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM api_tokens WHERE username = ?`, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ?`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// List all users, ordered by username.
+func (m *UserModel) List() ([]*User, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	rows, err := m.DB.Query(`SELECT id, username, role, disabled FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u := &User{}
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.Disabled); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Authenticate checks the password of the given user. Disabled users are
+// told apart only once their password is checked.
+func (m *UserModel) Authenticate(username, password string) error {
+	if m.DB == nil {
+		return ErrInvalidCredentials
+	}
+
+	var saltHex, hashHex string
+	var disabled bool
+	err := m.DB.QueryRow(`SELECT salt, hash, disabled FROM users WHERE username = ?`, username).Scan(&saltHex, &hashHex, &disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Hash the password anyway, so that unknown usernames take as long
+		// to reject as wrong passwords, and can't be told apart by timing.
+		hashPassword(password, dummySalt)
+		return ErrInvalidCredentials
+	} else if err != nil {
+		return err
+	}
+
+	// Decode salt and saved hash to bytes.
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return fmt.Errorf("decoding saved salt to bytes: %v", err)
+	}
+	savedHash, err := hex.DecodeString(hashHex)
+	if err != nil {
+		return fmt.Errorf("decoding saved argon2id hash to bytes: %v", err)
+	}
+
+	// Compute Argon2id key and compare with saved hash.
+	if subtle.ConstantTimeCompare(hashPassword(password, salt), savedHash) != 1 {
+		return ErrInvalidCredentials
+	}
+	if disabled {
+		return ErrUserDisabled
+	}
+	return nil
+}
+
+// expectAffected returns ErrNoRecord if the statement didn't touch any row.
+func expectAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l := NewLocal(t.TempDir())
+
+	if err := l.Put(ctx, "dir/hello.txt", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := l.Stat(ctx, "dir/hello.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 5 {
+		t.Errorf("info.Size = %d, want 5", info.Size)
+	}
+	f, err := l.Open(ctx, "dir/hello.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("contents = %q, want %q", got, "hello")
+	}
+
+	if err := l.Rename(ctx, "dir/hello.txt", "other/hello.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := l.Stat(ctx, "dir/hello.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat after Rename: err = %v, want ErrNotExist", err)
+	}
+
+	if err := l.Delete(ctx, "other/hello.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := l.Delete(ctx, "other/hello.txt"); err != nil {
+		t.Errorf("deleting missing object: %v", err)
+	}
+	if _, err := l.Open(ctx, "other/hello.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Open after Delete: err = %v, want ErrNotExist", err)
+	}
+}
+
+func TestLocalRejectsEscapingNames(t *testing.T) {
+	ctx := context.Background()
+	l := NewLocal(t.TempDir())
+
+	for _, name := range []string{"../x", "/etc/passwd", "", "a/../../x"} {
+		if err := l.Put(ctx, name, strings.NewReader("x"), 1); err == nil {
+			t.Errorf("Put(%q) succeeded, want error", name)
+		}
+	}
+}
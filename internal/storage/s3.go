@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Part size used for uploads of unknown size. The S3 client buffers a whole
+// part in memory before sending it.
+const s3PartSize = 16 << 20 // 16 MiB
+
+type S3Config struct {
+	Endpoint        string `toml:"endpoint"`
+	Region          string `toml:"region"`
+	Bucket          string `toml:"bucket"`
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	// Insecure makes the client talk plain HTTP, e.g. to a local MinIO.
+	Insecure bool `toml:"insecure"`
+}
+
+// S3 stores objects in a bucket of an S3-compatible object store.
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: S3 endpoint and bucket must be set")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage: creating S3 client: %v", err)
+	}
+	return &S3{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+	})
+	return mapS3Error(err)
+}
+
+func (s *S3) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	// GetObject doesn't contact the server, so check the object exists before
+	// handing it out.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, mapS3Error(err)
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(ctx context.Context, name string) (Info, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return Info{}, mapS3Error(err)
+	}
+	return Info{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) Rename(ctx context.Context, oldName, newName string) error {
+	// S3 has no rename, so copy the object server-side and delete the
+	// original. ComposeObject, unlike CopyObject, handles objects over 5 GiB.
+	_, err := s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: newName},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: oldName},
+	)
+	if err != nil {
+		return mapS3Error(err)
+	}
+	return s.Delete(ctx, oldName)
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	return mapS3Error(s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}))
+}
+
+// mapS3Error wraps "not found" responses so that they match ErrNotExist.
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %v", ErrNotExist, err)
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+// Package storage implements the backends where uploaded files are kept.
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// ErrNotExist is returned (possibly wrapped) when an object doesn't exist.
+var ErrNotExist = fs.ErrNotExist
+
+// Info describes a stored object.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is a flat namespace of objects, addressed by slash-separated names.
+type Storage interface {
+	// Put stores the contents of r under name, replacing any existing
+	// object. size is the number of bytes r will yield, or -1 if unknown.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Open opens the object stored under name for reading.
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+	// Stat returns information about the object stored under name.
+	Stat(ctx context.Context, name string) (Info, error)
+	// Rename moves the object stored under oldName to newName, replacing any
+	// object already stored there.
+	Rename(ctx context.Context, oldName, newName string) error
+	// Delete removes the object stored under name. Deleting an object that
+	// doesn't exist is not an error.
+	Delete(ctx context.Context, name string) error
+}
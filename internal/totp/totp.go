@@ -0,0 +1,102 @@
+// Package totp implements the time-based one-time passwords of RFC 6238, as
+// generated by authenticator apps, with their usual parameters: HMAC-SHA1,
+// 6 digits and a 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digits = 6
+	period = 30 * time.Second
+	// secretSize is the size of secrets in bytes, as recommended by RFC
+	// 4226 for HMAC-SHA1.
+	secretSize = 20
+	// skew is how many periods codes may be early or late, to make up for
+	// clock drift and typing time.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret generates a secret, encoded in base32 as authenticator apps
+// expect it.
+func NewSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating TOTP secret: %v", err)
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URI returns the otpauth URI that authenticator apps are provisioned with,
+// usually through a QR code.
+func URI(secret, issuer, account string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(digits)},
+			"period":    {fmt.Sprint(int(period.Seconds()))},
+		}.Encode(),
+	}
+	return u.String()
+}
+
+// Step returns the time step of t, i.e. the number of periods since the
+// Unix epoch.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(period.Seconds())
+}
+
+// Code returns the code of a secret at the given time step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("decoding TOTP secret: %v", err)
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, n%1_000_000), nil
+}
+
+// Validate checks a code against a secret at time t. Codes of time steps up
+// to lastStep are rejected, so that a code can't be used twice. It returns
+// the time step of the code if it's valid, or 0 if it isn't.
+func Validate(secret, code string, t time.Time, lastStep int64) (int64, error) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != digits {
+		return 0, nil
+	}
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, nil
+}
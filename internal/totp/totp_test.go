@@ -0,0 +1,56 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the test vectors of RFC 6238.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// The last 6 digits of the 8 digit codes of RFC 6238, appendix B.
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Code at %d = %q, want %q", unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	step := Step(now)
+	code, err := Code(secret, step-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Validate(secret, code, now, 0); err != nil || got != step-1 {
+		t.Errorf("Validate(code of previous step) = %d, %v, want %d", got, err, step-1)
+	}
+	if got, _ := Validate(secret, code, now, step-1); got != 0 {
+		t.Errorf("Validate(code already used) = %d, want 0", got)
+	}
+	if got, _ := Validate(secret, code, now.Add(time.Minute), 0); got != 0 {
+		t.Errorf("Validate(code of 3 steps ago) = %d, want 0", got)
+	}
+	if got, _ := Validate(secret, "12345", now, 0); got != 0 {
+		t.Errorf("Validate(short code) = %d, want 0", got)
+	}
+}
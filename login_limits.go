@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// Failed logins are counted both per IP address and per username, so that
+// neither guessing many passwords of one user nor a few passwords of many
+// users goes unchecked. Once a client has failed more than a few times, it
+// must wait before trying again, twice as long after each failure, until
+// it's locked out altogether.
+type loginPolicy struct {
+	// freeFailures is how many times a client may fail to log in before
+	// having to wait.
+	freeFailures int
+	// lockoutFailures is how many failures get a client locked out.
+	lockoutFailures int
+}
+
+var (
+	userLoginPolicy = loginPolicy{freeFailures: 3, lockoutFailures: 10}
+	// Many users may share an IP address, e.g. behind a NAT.
+	ipLoginPolicy = loginPolicy{freeFailures: 10, lockoutFailures: 50}
+)
+
+const (
+	// loginBackoff is how long clients wait after their first failure
+	// beyond the free ones.
+	loginBackoff = time.Second
+	// loginLockout is how long clients are locked out for.
+	loginLockout = 15 * time.Minute
+	// loginFailureWindow is how long failures are remembered for, since
+	// the last one.
+	loginFailureWindow = 24 * time.Hour
+)
+
+// passwordSem limits how many passwords are checked at once, as Argon2 takes
+// 60 MiB of memory per check.
+var passwordSem = make(chan struct{}, 4)
+
+// tooManyLoginsError is returned for login attempts made before the client is
+// allowed to try again.
+type tooManyLoginsError struct {
+	retryAfter time.Duration
+}
+
+func (e *tooManyLoginsError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry after %v", e.retryAfter)
+}
+
+// loginLimiter counts failed logins and tells how long clients must wait
+// before trying again. Failures are kept in memory, and also saved to the
+// database if store isn't nil.
+type loginLimiter struct {
+	logger *StderrLogger
+	store  *models.LoginFailureModel
+
+	mu       sync.Mutex
+	failures map[string]*models.LoginFailures
+}
+
+// newLoginLimiter returns a login limiter, loading the failures saved in
+// store if it isn't nil.
+func newLoginLimiter(logger *StderrLogger, store *models.LoginFailureModel) (*loginLimiter, error) {
+	l := &loginLimiter{logger: logger, store: store, failures: map[string]*models.LoginFailures{}}
+	if store == nil {
+		return l, nil
+	}
+	failures, err := store.List(time.Now().Add(-loginFailureWindow))
+	if err != nil {
+		return nil, fmt.Errorf("loading failed logins: %v", err)
+	}
+	for _, f := range failures {
+		l.failures[f.Key] = f
+	}
+	return l, nil
+}
+
+func ipKey(ip string) string         { return "ip:" + ip }
+func userKey(username string) string { return "user:" + username }
+
+// wait returns how long a client must wait before trying to log in again, or
+// 0 if it may try now.
+func (l *loginLimiter) wait(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string{ipKey(ip), userKey(username)} {
+		if f, ok := l.failures[key]; ok {
+			wait = max(wait, f.LockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed login.
+func (l *loginLimiter) fail(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.record(ipKey(ip), ipLoginPolicy)
+	l.record(userKey(username), userLoginPolicy)
+}
+
+// attempt starts a login attempt, unless the client must wait first, in which
+// case it returns how long. The attempt is counted as failed right away, so
+// that concurrent attempts can't all get past the limits before any of them
+// has failed; done must be called once the attempt is over, to take it back
+// if it didn't fail.
+func (l *loginLimiter) attempt(ip, username string) (done func(failed bool), wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{ipKey(ip), userKey(username)} {
+		if f, ok := l.failures[key]; ok {
+			wait = max(wait, f.LockedUntil.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return nil, wait
+	}
+	undoIP := l.record(ipKey(ip), ipLoginPolicy)
+	undoUser := l.record(userKey(username), userLoginPolicy)
+	return func(failed bool) {
+		if failed {
+			return
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		undoIP()
+		undoUser()
+	}, 0
+}
+
+// record records a failure of a client, and returns a function taking it
+// back, to be called with l.mu held.
+func (l *loginLimiter) record(key string, policy loginPolicy) (undo func()) {
+	now := time.Now()
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.Last) > loginFailureWindow {
+		f = &models.LoginFailures{Key: key}
+		l.failures[key] = f
+	}
+	lockedUntil := f.LockedUntil
+	f.Count++
+	f.Last = now
+	switch {
+	case f.Count >= policy.lockoutFailures:
+		f.LockedUntil = now.Add(loginLockout)
+		l.logger.Warn("locking out %s for %v after %d failed logins", key, loginLockout, f.Count)
+	case f.Count > policy.freeFailures:
+		backoff := loginBackoff << min(f.Count-policy.freeFailures-1, 10)
+		f.LockedUntil = now.Add(min(backoff, loginLockout))
+	}
+	l.save(f)
+
+	recorded := f.LockedUntil
+	return func() {
+		if l.failures[key] != f {
+			// Forgotten since.
+			return
+		}
+		f.Count--
+		if f.LockedUntil.Equal(recorded) {
+			f.LockedUntil = lockedUntil
+		}
+		l.save(f)
+	}
+}
+
+// save saves the failed logins of a client to the store, if there's one.
+func (l *loginLimiter) save(f *models.LoginFailures) {
+	if l.store == nil {
+		return
+	}
+	if err := l.store.Save(f); err != nil {
+		l.logger.Error("saving failed logins of %s: %v", f.Key, err)
+	}
+}
+
+// succeed forgets the failed logins for a username once its user has logged
+// in, with their second factor if they use one. Those of the IP address are
+// kept, so that an attacker can't reset them by logging in as themselves.
+func (l *loginLimiter) succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := userKey(username)
+	if _, ok := l.failures[key]; !ok {
+		return
+	}
+	delete(l.failures, key)
+	if l.store != nil {
+		if err := l.store.Delete(key); err != nil {
+			l.logger.Error("deleting failed logins of %s: %v", key, err)
+		}
+	}
+}
+
+// forgetOldFailures forgets the failed logins of the clients that haven't
+// failed in a while.
+func (l *loginLimiter) forgetOldFailures() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-loginFailureWindow)
+	for key, f := range l.failures {
+		if f.Last.Before(cutoff) {
+			delete(l.failures, key)
+		}
+	}
+	if l.store != nil {
+		return l.store.DeleteBefore(cutoff)
+	}
+	return nil
+}
+
+// forgetLoginFailures periodically forgets old failed logins. It never
+// returns.
+func (a App) forgetLoginFailures(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.logins.forgetOldFailures(); err != nil {
+			a.Logger.Error("deleting old failed logins: %v", err)
+		}
+	}
+}
+
+// checkPassword checks the password of a user logging in, unless the client
+// has failed to do so too many times recently. Callers must tell a.logins
+// once the user has succeeded.
+func (a App) checkPassword(r *http.Request, username, password string) error {
+	done, wait := a.logins.attempt(clientIP(r), username)
+	if wait > 0 {
+		return &tooManyLoginsError{wait}
+	}
+
+	passwordSem <- struct{}{}
+	err := a.users.Authenticate(username, password)
+	<-passwordSem
+	done(errors.Is(err, models.ErrInvalidCredentials))
+	return err
+}
+
+// clientIP returns the IP address of the client making a request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyLogins returns a Too Many Requests response to a login attempt.
+func tooManyLogins(w http.ResponseWriter, err *tooManyLoginsError) {
+	w.Header().Set("Retry-After", retryAfter(err))
+	http.Error(w, "Too many failed logins. Try again later.", http.StatusTooManyRequests)
+}
+
+// retryAfter returns the Retry-After header of a response to a login
+// attempt that was made too soon, in whole seconds.
+func retryAfter(err *tooManyLoginsError) string {
+	return strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds())))
+}
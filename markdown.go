@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// markdownLanguage is the language of texts rendered as Markdown. Texts
+// uploaded in it are saved with a .md extension.
+const markdownLanguage = "markdown"
+
+// markdown lets raw HTML through, as READMEs often have some; it's left to
+// markdownPolicy to make it safe.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// markdownPolicy sanitizes the HTML rendered from Markdown, which may come
+// from anyone with an account.
+var markdownPolicy = bluemonday.UGCPolicy()
+
+// isMarkdown reports whether an uploaded file is rendered as Markdown.
+func isMarkdown(f *models.UploadedFile) bool {
+	switch strings.ToLower(filepath.Ext(f.Filename)) {
+	case ".md", ".markdown":
+		return true
+	default:
+		return false
+	}
+}
+
+// renderMarkdown renders Markdown text as sanitized HTML.
+func renderMarkdown(text string) (string, error) {
+	var b bytes.Buffer
+	if err := markdown.Convert([]byte(text), &b); err != nil {
+		return "", fmt.Errorf("rendering Markdown: %v", err)
+	}
+	return markdownPolicy.Sanitize(b.String()), nil
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsilvap/hermes/internal/storage"
+)
+
+// The schema in sql/hermes.sql is the one of the first release of hermes.
+// Later changes are applied by the migrations below, in order. The number of
+// migrations applied to a database is kept in SQLite's user_version pragma.
+var migrations = []func(m *migrator) error{
+	migrateContentAddressedBlobs,
+	migrateSlugs,
+	migrateExpiration,
+	migrateBurnAfterReading,
+	migrateAPITokens,
+	migrateTusUploads,
+	migrateLanguage,
+	migrateStrippedMetadata,
+	migrateMIMETypes,
+	migrateLoginFailures,
+	migrateTOTP,
+	migrateSessions,
+	migrateRoles,
+	migrateDisabledUsers,
+	migrateVisibility,
+	migrateUniqueUsernames,
+	migrateSessionUsers,
+}
+
+// migrator holds what a migration needs to run.
+type migrator struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	storage storage.Storage
+	logger  *StderrLogger
+
+	// Functions to run once the migration has been committed.
+	afterCommit []func()
+}
+
+// migrate applies the pending migrations to db.
+func migrate(ctx context.Context, db *sql.DB, store storage.Storage, logger *StderrLogger) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		m := &migrator{ctx: ctx, tx: tx, storage: store, logger: logger}
+		if err := migrations[version](m); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to version %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to version %d: %v", version+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migrating database to version %d: %v", version+1, err)
+		}
+		for _, f := range m.afterCommit {
+			f()
+		}
+		logger.Info("Migrated database to version %d.", version+1)
+	}
+	return nil
+}
+
+// migrateContentAddressedBlobs moves uploaded files, stored until now under
+// the name they were uploaded with, to blobs named by their SHA-256 digest.
+func migrateContentAddressedBlobs(m *migrator) error {
+	_, err := m.tx.Exec(`
+CREATE TABLE blobs (
+       digest TEXT PRIMARY KEY,
+       size INTEGER NOT NULL,
+       refcount INTEGER NOT NULL
+);
+ALTER TABLE uploaded_files RENAME COLUMN file_path TO filename;
+ALTER TABLE uploaded_files ADD COLUMN digest TEXT REFERENCES blobs(digest);
+`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := m.tx.Query(`SELECT id, filename FROM uploaded_files`)
+	if err != nil {
+		return err
+	}
+	filenames := map[int]string{}
+	for rows.Next() {
+		var id int
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			rows.Close()
+			return err
+		}
+		filenames[id] = filename
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Several rows may share a file, since uploads with the same name used to
+	// overwrite each other.
+	digests := map[string]string{}
+	for id, filename := range filenames {
+		filename := filename
+		digest, ok := digests[filename]
+		if !ok {
+			var size int64
+			digest, size, err = copyToBlob(m.ctx, m.storage, filename)
+			if err != nil {
+				// Rather than losing the upload, stop, so that the storage
+				// can be fixed and the migration retried. Files copied so
+				// far are left in place, and copied again next time.
+				return fmt.Errorf("copying file %q of uploaded file %d to a blob: %v", filename, id, err)
+			}
+			_, err = m.tx.Exec(`INSERT INTO blobs(digest, size, refcount) VALUES(?, ?, 0) ON CONFLICT(digest) DO NOTHING`, digest, size)
+			if err != nil {
+				return err
+			}
+			digests[filename] = digest
+			if digest != filename {
+				m.afterCommit = append(m.afterCommit, func() {
+					if err := m.storage.Delete(m.ctx, filename); err != nil {
+						m.logger.Warn("migration: deleting old file %q: %v", filename, err)
+					}
+				})
+			}
+		}
+		_, err := m.tx.Exec(`UPDATE uploaded_files SET digest = ? WHERE id = ?`, digest, id)
+		if err != nil {
+			return err
+		}
+		_, err = m.tx.Exec(`UPDATE blobs SET refcount = refcount + 1 WHERE digest = ?`, digest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSlugs gives every uploaded file a random slug to be used in URLs
+// instead of its ID. Existing files are marked as legacy, so that old links
+// with IDs still work.
+func migrateSlugs(m *migrator) error {
+	_, err := m.tx.Exec(`
+ALTER TABLE uploaded_files ADD COLUMN slug TEXT;
+ALTER TABLE uploaded_files ADD COLUMN legacy BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE uploaded_files SET legacy = TRUE;
+CREATE UNIQUE INDEX uploaded_files_slug ON uploaded_files(slug);
+`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := m.tx.Query(`SELECT id FROM uploaded_files`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		slug, err := generateSlug()
+		if err != nil {
+			return err
+		}
+		if _, err := m.tx.Exec(`UPDATE uploaded_files SET slug = ? WHERE id = ?`, slug, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateExpiration lets uploaded files expire.
+func migrateExpiration(m *migrator) error {
+	_, err := m.tx.Exec(`
+ALTER TABLE uploaded_files ADD COLUMN expires_at DATETIME;
+CREATE INDEX uploaded_files_expires_at ON uploaded_files(expires_at);
+`)
+	return err
+}
+
+// migrateBurnAfterReading lets uploaded files be deleted once read.
+func migrateBurnAfterReading(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE uploaded_files ADD COLUMN burn_after_reading BOOLEAN NOT NULL DEFAULT FALSE`)
+	return err
+}
+
+// migrateAPITokens adds personal API tokens, stored hashed.
+func migrateAPITokens(m *migrator) error {
+	_, err := m.tx.Exec(`
+CREATE TABLE api_tokens (
+       id INTEGER PRIMARY KEY,
+       username TEXT NOT NULL,
+       name TEXT NOT NULL,
+       hash TEXT NOT NULL UNIQUE,
+       scopes TEXT NOT NULL,
+       created_at DATETIME NOT NULL,
+       last_used_at DATETIME
+);
+CREATE INDEX api_tokens_username ON api_tokens(username);
+`)
+	return err
+}
+
+// migrateTusUploads adds the resumable uploads made through tus.
+func migrateTusUploads(m *migrator) error {
+	_, err := m.tx.Exec(`
+CREATE TABLE tus_uploads (
+       id TEXT PRIMARY KEY,
+       uploader TEXT NOT NULL,
+       length INTEGER NOT NULL,
+       metadata TEXT NOT NULL,
+       slug TEXT,
+       created_at DATETIME NOT NULL,
+       expires_at DATETIME NOT NULL
+);
+CREATE INDEX tus_uploads_expires_at ON tus_uploads(expires_at);
+`)
+	return err
+}
+
+// migrateLanguage adds the language text files are highlighted as.
+func migrateLanguage(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE uploaded_files ADD COLUMN language TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// migrateStrippedMetadata records the metadata removed from uploaded images,
+// as a comma-separated list.
+func migrateStrippedMetadata(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE uploaded_files ADD COLUMN stripped_metadata TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// migrateMIMETypes records the media type of uploaded files, detected from
+// their contents. Existing files are kept even if their contents don't match
+// their extension.
+func migrateMIMETypes(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE uploaded_files ADD COLUMN mime_type TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := m.tx.Query(`SELECT id, filename, digest FROM uploaded_files`)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		id               int
+		filename, digest string
+	}
+	var files []file
+	for rows.Next() {
+		var f file
+		if err := rows.Scan(&f.id, &f.filename, &f.digest); err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		mimeType, err := readMIMEType(m.ctx, m.storage, f.filename, f.digest)
+		if err != nil {
+			m.logger.Warn("migration: detecting media type of uploaded file %d: %v", f.id, err)
+			mimeType = mime.TypeByExtension(filepath.Ext(f.filename))
+		}
+		if _, err := m.tx.Exec(`UPDATE uploaded_files SET mime_type = ? WHERE id = ?`, mimeType, f.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLoginFailures adds the failed logins kept when login rate limits
+// are persisted.
+func migrateLoginFailures(m *migrator) error {
+	_, err := m.tx.Exec(`
+CREATE TABLE login_failures (
+       key TEXT PRIMARY KEY,
+       count INTEGER NOT NULL,
+       last_failure_at DATETIME NOT NULL,
+       locked_until DATETIME
+);
+`)
+	return err
+}
+
+// migrateTOTP lets users log in with a TOTP code besides their password, or
+// one of their recovery codes, stored hashed.
+func migrateTOTP(m *migrator) error {
+	_, err := m.tx.Exec(`
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE recovery_codes (
+       id INTEGER PRIMARY KEY,
+       username TEXT NOT NULL,
+       hash TEXT NOT NULL
+);
+CREATE INDEX recovery_codes_username ON recovery_codes(username);
+`)
+	return err
+}
+
+// migrateSessions keeps sessions in the database, rather than in memory, so
+// that restarting hermes doesn't log everyone out.
+func migrateSessions(m *migrator) error {
+	_, err := m.tx.Exec(`
+CREATE TABLE sessions (
+       token TEXT PRIMARY KEY,
+       data BLOB NOT NULL,
+       expires_at DATETIME NOT NULL
+);
+CREATE INDEX sessions_expires_at ON sessions(expires_at);
+`)
+	return err
+}
+
+// migrateRoles gives users a role. Existing users become uploaders, which
+// lets them do what they could do before.
+func migrateRoles(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'uploader'`)
+	return err
+}
+
+// migrateDisabledUsers lets admins disable users, who then can't log in.
+func migrateDisabledUsers(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`)
+	return err
+}
+
+// migrateVisibility lets uploaders choose who can see their uploads.
+// Existing uploads are public, as they were before.
+func migrateVisibility(m *migrator) error {
+	_, err := m.tx.Exec(`ALTER TABLE uploaded_files ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public'`)
+	return err
+}
+
+// migrateUniqueUsernames keeps two users from having the same username.
+// Databases that already have duplicate usernames must be fixed by hand.
+func migrateUniqueUsernames(m *migrator) error {
+	rows, err := m.tx.Query(`SELECT username FROM users GROUP BY username HAVING count(*) > 1 ORDER BY username`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var duplicates []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return err
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%q", username))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("several users have the same username, rename or delete them first: %s", strings.Join(duplicates, ", "))
+	}
+
+	_, err = m.tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS users_username ON users(username)`)
+	return err
+}
+
+// migrateSessionUsers stores who sessions are logged in as, to find the
+// sessions of a user without decoding every session, and cuts anonymous
+// sessions down to anonymousSessionLifetime.
+func migrateSessionUsers(m *migrator) error {
+	_, err := m.tx.Exec(`
+ALTER TABLE sessions ADD COLUMN username TEXT NOT NULL DEFAULT '';
+CREATE INDEX sessions_username ON sessions(username);
+`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := m.tx.Query(`SELECT token, data FROM sessions`)
+	if err != nil {
+		return err
+	}
+	users := map[string]string{}
+	for rows.Next() {
+		var token string
+		var data []byte
+		if err := rows.Scan(&token, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		username, _, err := decodeSession(data)
+		if err != nil {
+			// An unreadable session can't be loaded anyway.
+			m.logger.Warn("migration: decoding session, it is left anonymous: %v", err)
+			continue
+		}
+		if username != "" {
+			users[token] = username
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for token, username := range users {
+		if _, err := m.tx.Exec(`UPDATE sessions SET username = ? WHERE token = ?`, username, token); err != nil {
+			return err
+		}
+	}
+	_, err = m.tx.Exec(`UPDATE sessions SET expires_at = min(expires_at, datetime('now', ?)) WHERE username = ''`,
+		fmt.Sprintf("+%d seconds", int(anonymousSessionLifetime.Seconds())))
+	return err
+}
+
+// readMIMEType detects the media type of a stored blob, ignoring whether it
+// matches the extension of filename.
+func readMIMEType(ctx context.Context, store storage.Storage, filename, digest string) (string, error) {
+	f, err := store.Open(ctx, digest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	mimeType, _ := detectMIMEType(filename, head[:n])
+	return mimeType, nil
+}
+
+// copyToBlob copies the object stored under name to a blob named by its
+// digest.
+func copyToBlob(ctx context.Context, store storage.Storage, name string) (string, int64, error) {
+	h := sha256.New()
+	f, err := store.Open(ctx, name)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest == name {
+		// Already a blob.
+		return digest, size, nil
+	}
+
+	f, err = store.Open(ctx, name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	if err := store.Put(ctx, digest, f, size); err != nil {
+		return "", 0, err
+	}
+	return digest, size, nil
+}
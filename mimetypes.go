@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sniffLen is the number of bytes that media types are detected from.
+const sniffLen = 512
+
+// errMIMEMismatch is returned for files whose contents don't match their
+// extension.
+var errMIMEMismatch = fmt.Errorf("%w: contents don't match the file extension", errBadUpload)
+
+// detectMIMEType returns the media type of a file, given its name and the
+// first bytes of its contents. The type is sniffed from the contents; the
+// extension only refines it when the contents are text, or when they're of
+// a format that can't be sniffed.
+//
+// Files whose contents are of a different kind than their extension, such
+// as HTML saved as .jpg or a PNG image saved as .txt, are rejected with an
+// error wrapping errMIMEMismatch, along with the sniffed type.
+func detectMIMEType(filename string, head []byte) (string, error) {
+	sniffed := http.DetectContentType(head)
+	byExt := mime.TypeByExtension(filepath.Ext(filename))
+	if byExt == "" {
+		return sniffed, nil
+	}
+
+	sniffedType, _ := splitMIMEType(sniffed)
+	extType, extSubtype := splitMIMEType(byExt)
+	switch {
+	case sniffed == "application/octet-stream":
+		// Binary, in a format that can't be sniffed.
+		if extType == "text" {
+			return sniffed, errMIMEMismatch
+		}
+		return byExt, nil
+	case sniffedType == "text":
+		// Text files can't be told apart by their contents alone. SVG
+		// images are XML, so they're text too.
+		if extType == "text" || extType == "application" || extType+"/"+extSubtype == "image/svg+xml" {
+			return byExt, nil
+		}
+		if extType == "image" {
+			return sniffed, errMIMEMismatch
+		}
+		// Other extensions are shared by text and binary formats, as .ts
+		// is by TypeScript and MPEG transport streams, so the contents
+		// tell which one the file is.
+		return sniffed, nil
+	case sniffedType == extType:
+		return sniffed, nil
+	case isAudioVisual(sniffed) && isAudioVisual(byExt):
+		return byExt, nil
+	default:
+		return sniffed, errMIMEMismatch
+	}
+}
+
+// splitMIMEType returns the type and subtype of a media type, without its
+// parameters.
+func splitMIMEType(mimeType string) (typ, subtype string) {
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	typ, subtype, _ = strings.Cut(strings.TrimSpace(mediaType), "/")
+	return typ, subtype
+}
+
+// isAudioVisual reports whether a media type is of audio or video. They're
+// often told apart by extension only, as in .m4a and .mp4 files.
+func isAudioVisual(mimeType string) bool {
+	typ, subtype := splitMIMEType(mimeType)
+	return typ == "audio" || typ == "video" || typ == "application" && subtype == "ogg"
+}
+
+// extensionByType returns the extension of files of a media type, or "" if
+// it has none. Text files are given .txt.
+func extensionByType(mimeType string) string {
+	typ, subtype := splitMIMEType(mimeType)
+	if typ == "text" {
+		return ".txt"
+	}
+	exts, _ := mime.ExtensionsByType(typ + "/" + subtype)
+	if len(exts) == 0 {
+		return ""
+	}
+	// Extensions are sorted, so prefer the one named after the subtype, as
+	// in .jpeg over .jfif.
+	if i := slices.Index(exts, "."+subtype); i >= 0 {
+		return exts[i]
+	}
+	return exts[0]
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// currentRole returns the role of the user making the request, or "" if
+// they aren't logged in. Sessions carry the role of their user since they
+// logged in; requests authenticated with an API token get it from the
+// database.
+func (a App) currentRole(r *http.Request) (string, error) {
+	if t := requestToken(r); t != nil {
+		role, err := a.users.Role(t.Username)
+		if errors.Is(err, models.ErrNoRecord) {
+			return "", nil
+		}
+		return role, err
+	}
+	if !sessionManager.GetBool(r.Context(), "authenticated") {
+		return "", nil
+	}
+	if role := sessionManager.GetString(r.Context(), "role"); role != "" {
+		return role, nil
+	}
+
+	// The session was created before users had roles.
+	role, err := a.users.Role(sessionManager.GetString(r.Context(), "user"))
+	if errors.Is(err, models.ErrNoRecord) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	sessionManager.Put(r.Context(), "role", role)
+	return role, nil
+}
+
+// hasRole reports whether the user making the request has the given role,
+// or a more privileged one.
+func (a App) hasRole(r *http.Request, role string) (bool, error) {
+	current, err := a.currentRole(r)
+	if err != nil || current == "" {
+		return false, err
+	}
+	return slices.Index(models.Roles, current) >= slices.Index(models.Roles, role), nil
+}
+
+// canModify reports whether the user making the request may edit or delete
+// an upload: its uploader and admins may.
+func (a App) canModify(r *http.Request, f *models.UploadedFile) (bool, error) {
+	if user := currentUser(r); user != "" && user == f.Uploader {
+		return true, nil
+	}
+	return a.hasRole(r, models.RoleAdmin)
+}
+
+// requireRole rejects requests made by users without the given role, or a
+// more privileged one. It must come after the middlewares requiring users to
+// log in.
+func (a App) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, err := a.hasRole(r, role)
+			if err != nil {
+				a.Logger.Error("%s %s: getting role of user %q: %v", r.Method, r.URL.Path, currentUser(r), err)
+				if isAPIRequest(r) {
+					apiInternalServerError(w)
+				} else {
+					internalServerError(w)
+				}
+				return
+			}
+			if !ok {
+				message := "You need the " + role + " role to do this."
+				if isAPIRequest(r) {
+					writeAPIError(w, http.StatusForbidden, "insufficient_role", message)
+				} else {
+					forbidden(w, message)
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
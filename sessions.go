@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// Sessions are kept in the database by scs, encoded, along with the user
+// they're logged in as. They're shown to users by an ID derived from their
+// token, since the token itself lets anyone in.
+
+// anonymousSessionLifetime is how long sessions that aren't logged in, such
+// as the ones made by the login page for its CSRF token, are kept. Anyone can
+// make them, so they mustn't pile up.
+const anonymousSessionLifetime = time.Hour
+
+// sessionStore is the scs.Store of sessions, which tells the database who
+// they're logged in as.
+type sessionStore struct {
+	*models.SessionModel
+}
+
+func (s sessionStore) Commit(token string, data []byte, expires time.Time) error {
+	username, _, err := decodeSession(data)
+	if err != nil {
+		return err
+	}
+	if limit := time.Now().Add(anonymousSessionLifetime); username == "" && expires.After(limit) {
+		expires = limit
+	}
+	return s.Save(token, username, data, expires)
+}
+
+// decodeSession returns the user a session is logged in as, or "" if it
+// isn't, and its values.
+func decodeSession(data []byte) (username string, values map[string]any, err error) {
+	_, values, err = sessionManager.Codec.Decode(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding session: %v", err)
+	}
+	if authenticated, _ := values["authenticated"].(bool); authenticated {
+		username, _ = values["user"].(string)
+	}
+	return username, values, nil
+}
+
+// userSession is a session a user is logged in with.
+type userSession struct {
+	ID string
+	// Current is whether it's the session the list was requested with.
+	Current   bool
+	LoggedIn  time.Time
+	IP        string
+	UserAgent string
+	Expires   time.Time
+}
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// userSessions returns the sessions a user is logged in with, newest first.
+// The session of ctx is marked as the current one.
+func userSessions(ctx context.Context, store *models.SessionModel, username string) ([]userSession, error) {
+	data, err := store.OfUser(username)
+	if err != nil {
+		return nil, err
+	}
+	current := sessionManager.Token(ctx)
+	var sessions []userSession
+	for token, d := range data {
+		deadline, values, err := sessionManager.Codec.Decode(d)
+		if err != nil {
+			return nil, fmt.Errorf("decoding session: %v", err)
+		}
+		s := userSession{
+			ID:      sessionID(token),
+			Current: token == current,
+			Expires: deadline,
+		}
+		s.IP, _ = values["ip"].(string)
+		s.UserAgent, _ = values["user_agent"].(string)
+		if loggedIn, _ := values["logged_in_at"].(int64); loggedIn != 0 {
+			s.LoggedIn = time.Unix(loggedIn, 0)
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LoggedIn.After(sessions[j].LoggedIn)
+	})
+	return sessions, nil
+}
+
+// revokeSessions logs out the sessions of a user whose ID revoke returns true
+// for, and returns how many there were.
+func revokeSessions(store *models.SessionModel, username string, revoke func(id string) bool) (int, error) {
+	data, err := store.OfUser(username)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for token := range data {
+		if !revoke(sessionID(token)) {
+			continue
+		}
+		if err := store.Delete(token); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// deleteExpiredSessions periodically deletes expired sessions from the
+// database. It never returns.
+func (a App) deleteExpiredSessions(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.sessions.DeleteExpired(); err != nil {
+			a.Logger.Error("deleting expired sessions: %v", err)
+		}
+	}
+}
+
+// sessionsPage handles GET /sessions, which lists the sessions of the user.
+func (a App) sessionsPage(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/sessions.tmpl")
+	if err != nil {
+		a.Logger.Error("GET /sessions: parsing template: %v", err)
+		internalServerError(w)
+		return
+	}
+	username := sessionManager.GetString(r.Context(), "user")
+	sessions, err := userSessions(r.Context(), a.sessions, username)
+	if err != nil {
+		a.Logger.Error("GET /sessions: listing sessions of user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+	err = tmpl.Execute(w, map[string]any{
+		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
+		"User":          username,
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
+
+		"Sessions": sessions,
+	})
+	if err != nil {
+		a.Logger.Error("GET /sessions: executing template: %v", err)
+		internalServerError(w)
+		return
+	}
+}
+
+// revokeSessionAction handles POST /sessions/{sessionID}/revoke, logging
+// out one of the other sessions of the user.
+func (a App) revokeSessionAction(w http.ResponseWriter, r *http.Request) {
+	username := sessionManager.GetString(r.Context(), "user")
+	id := chi.URLParam(r, "sessionID")
+	current := sessionID(sessionManager.Token(r.Context()))
+	n, err := revokeSessions(a.sessions, username, func(sid string) bool {
+		return sid == id && sid != current
+	})
+	if err != nil {
+		a.Logger.Error("POST /sessions/%s/revoke: revoking session of user %q: %v", id, username, err)
+		internalServerError(w)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	sendTo(w, "/sessions")
+}
+
+// revokeOtherSessionsAction handles POST /sessions/revoke-others, logging
+// out every session of the user but the current one.
+func (a App) revokeOtherSessionsAction(w http.ResponseWriter, r *http.Request) {
+	username := sessionManager.GetString(r.Context(), "user")
+	current := sessionID(sessionManager.Token(r.Context()))
+	n, err := revokeSessions(a.sessions, username, func(sid string) bool {
+		return sid != current
+	})
+	if err != nil {
+		a.Logger.Error("POST /sessions/revoke-others: revoking sessions of user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+	a.Logger.Info("User %q logged out of %d other sessions.", username, n)
+	sendTo(w, "/sessions")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/tsilvap/hermes/internal/models"
+	"github.com/tsilvap/hermes/internal/storage"
+)
+
+// thumbnailSizes are the sizes thumbnails can be requested in, as the
+// maximum of their width and height in pixels.
+var thumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+}
+
+// maxThumbnailSourcePixels is the size of the largest image thumbnails are
+// made of, to keep decoding them from using too much memory.
+const maxThumbnailSourcePixels = 64 << 20
+
+// thumbnailSem limits how many thumbnails are made at once.
+var thumbnailSem = make(chan struct{}, 2)
+
+// errNoThumbnail is returned for files that thumbnails can't be made of.
+var errNoThumbnail = errors.New("no thumbnail")
+
+// thumbnailName returns the name under which the thumbnail of a blob is
+// cached, next to the blob itself.
+func thumbnailName(digest string, px int) string {
+	return path.Join("thumbs", digest+"-"+strconv.Itoa(px))
+}
+
+// thumbnail handles GET /thumb/{slug}, which serves a thumbnail of an image
+// in the size given by the "size" query parameter (medium by default).
+// Thumbnails are made on the first request and cached in storage.
+func (a App) thumbnail(w http.ResponseWriter, r *http.Request) {
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "medium"
+	}
+	px, ok := thumbnailSizes[size]
+	if !ok {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+	f, ok := a.uploadFromURL(w, r, "/thumb/")
+	if !ok {
+		return
+	}
+	if f.Type() != "image" || f.BurnAfterReading {
+		// Burn after reading images must only be seen once, in full.
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	name := thumbnailName(f.Digest, px)
+	thumb, err := a.storage.Open(r.Context(), name)
+	if errors.Is(err, storage.ErrNotExist) {
+		err = a.makeThumbnail(r.Context(), f, px)
+		if err == nil {
+			thumb, err = a.storage.Open(r.Context(), name)
+		}
+	}
+	if errors.Is(err, errNoThumbnail) || errors.Is(err, storage.ErrNotExist) {
+		a.Logger.Error("GET /thumb/: %v", err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		a.Logger.Error("GET /thumb/: %v", err)
+		internalServerError(w)
+		return
+	}
+	defer thumb.Close()
+
+	w.Header().Set("ETag", strconv.Quote(path.Base(name)))
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeContent(w, r, "", f.Created, thumb)
+}
+
+// makeThumbnail makes a thumbnail of an image that fits in a px by px
+// square, and caches it. Thumbnails of JPEG images are JPEG, and thumbnails
+// of other images are PNG, to keep their transparency.
+func (a App) makeThumbnail(ctx context.Context, f *models.UploadedFile, px int) error {
+	thumbnailSem <- struct{}{}
+	defer func() { <-thumbnailSem }()
+
+	blob, err := a.storage.Open(ctx, f.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	config, format, err := image.DecodeConfig(blob)
+	if err != nil {
+		return fmt.Errorf("%w: decoding %s: %v", errNoThumbnail, f.Slug, err)
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return fmt.Errorf("%w: %s is %dx%d", errNoThumbnail, f.Slug, config.Width, config.Height)
+	}
+	if _, err := blob.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(blob)
+	if err != nil {
+		return fmt.Errorf("%w: decoding %s: %v", errNoThumbnail, f.Slug, err)
+	}
+
+	bounds := scaleToFit(src.Bounds().Size(), px)
+	dst := image.NewRGBA(image.Rectangle{Max: bounds})
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var b bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&b, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&b, dst)
+	}
+	if err != nil {
+		return fmt.Errorf("encoding thumbnail of %s: %v", f.Slug, err)
+	}
+	return a.storage.Put(ctx, thumbnailName(f.Digest, px), &b, int64(b.Len()))
+}
+
+// scaleToFit returns the size of an image scaled down to fit in a px by px
+// square, keeping its aspect ratio. Smaller images are left as they are.
+func scaleToFit(size image.Point, px int) image.Point {
+	if size.X <= px && size.Y <= px {
+		return size
+	}
+	if size.X >= size.Y {
+		return image.Point{px, max(1, size.Y*px/size.X)}
+	}
+	return image.Point{max(1, size.X*px/size.Y), px}
+}
+
+// deleteThumbnails deletes the cached thumbnails of a blob.
+func (a App) deleteThumbnails(ctx context.Context, digest string) {
+	for _, px := range thumbnailSizes {
+		if err := a.storage.Delete(ctx, thumbnailName(digest, px)); err != nil {
+			a.Logger.Error("deleting thumbnail of blob %s: %v", digest, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+type contextKey int
+
+const tokenContextKey contextKey = iota
+
+// requestToken returns the API token the request was authenticated with, or
+// nil if it wasn't. See authenticateToken.
+func requestToken(r *http.Request) *models.APIToken {
+	t, _ := r.Context().Value(tokenContextKey).(*models.APIToken)
+	return t
+}
+
+// authenticateToken authenticates requests carrying an API token in an
+// "Authorization: Bearer" header. Requests with an invalid token are
+// rejected, rather than falling back to the session.
+func (a App) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, err := a.apiTokens.Authenticate(strings.TrimSpace(token))
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			if isAPIRequest(r) {
+				writeAPIError(w, http.StatusUnauthorized, "invalid_token", "Invalid API token.")
+			} else {
+				unauthorized(w)
+			}
+			return
+		} else if err != nil {
+			a.Logger.Error("%s %s: authenticating API token: %v", r.Method, r.URL.Path, err)
+			internalServerError(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, t)))
+	})
+}
+
+// requireScope rejects requests authenticated with an API token lacking the
+// given scope. Logging in through the browser grants every scope.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t := requestToken(r); t != nil && !t.HasScope(scope) {
+				message := "This API token doesn't have the " + scope + " scope."
+				if isAPIRequest(r) {
+					writeAPIError(w, http.StatusForbidden, "insufficient_scope", message)
+				} else {
+					forbidden(w, message)
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tokenScopeChoices are the scopes a token can be created with from the
+// tokens page.
+var tokenScopeChoices = map[string][]string{
+	"full":   models.AllScopes,
+	"upload": {models.ScopeUpload},
+	"read":   {models.ScopeRead},
+}
+
+func (a App) tokensPage(w http.ResponseWriter, r *http.Request) {
+	a.renderTokensPage(w, r, "GET /tokens", "")
+}
+
+func (a App) createTokenAction(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		a.Logger.Error("POST /tokens: parsing form: %v", err)
+		internalServerError(w)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	scopes, ok := tokenScopeChoices[r.PostForm.Get("scopes")]
+	if name == "" || !ok {
+		http.Error(w, "A token needs a name and valid scopes", http.StatusBadRequest)
+		return
+	}
+	token, err := a.apiTokens.Insert(sessionManager.GetString(r.Context(), "user"), name, scopes)
+	if err != nil {
+		a.Logger.Error("POST /tokens: %v", err)
+		internalServerError(w)
+		return
+	}
+	a.renderTokensPage(w, r, "POST /tokens", token)
+}
+
+func (a App) deleteTokenAction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	err = a.apiTokens.Delete(sessionManager.GetString(r.Context(), "user"), id)
+	if errors.Is(err, models.ErrNoRecord) {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		a.Logger.Error("POST /tokens/%d/delete: %v", id, err)
+		internalServerError(w)
+		return
+	}
+	sendTo(w, "/tokens")
+}
+
+// renderTokensPage renders the list of the user's tokens. newToken is a
+// token just created, which is shown this one time.
+func (a App) renderTokensPage(w http.ResponseWriter, r *http.Request, route, newToken string) {
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/tokens.tmpl")
+	if err != nil {
+		a.Logger.Error("%s: parsing template: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	tokens, err := a.apiTokens.List(sessionManager.GetString(r.Context(), "user"))
+	if err != nil {
+		a.Logger.Error("%s: listing tokens: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	err = tmpl.Execute(w, map[string]any{
+		"Authenticated": sessionManager.GetBool(r.Context(), "authenticated"),
+		"User":          sessionManager.GetString(r.Context(), "user"),
+		"CSRFToken":     csrfToken(r.Context()),
+		"Admin":         isAdminSession(r.Context()),
+
+		"Tokens":   tokens,
+		"NewToken": newToken,
+	})
+	if err != nil {
+		a.Logger.Error("%s: executing template: %v", route, err)
+		internalServerError(w)
+		return
+	}
+}
+
+// requireSession rejects requests that aren't authenticated by a browser
+// session, such as ones made with an API token.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestToken(r) != nil || !sessionManager.GetBool(r.Context(), "authenticated") {
+			unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
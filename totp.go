@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/tsilvap/hermes/internal/models"
+	"github.com/tsilvap/hermes/internal/totp"
+)
+
+// Users may enable TOTP as a second factor, after which logging in takes
+// two steps: their password first, then a code from their authenticator app
+// or one of their recovery codes. Between both steps, the session holds the
+// user who entered their password, but isn't authenticated yet.
+
+// totpLoginTimeout is how long users have to enter a code after their
+// password.
+const totpLoginTimeout = 5 * time.Minute
+
+// startTOTPLogin records in the session that a user entered their password,
+// and must now enter a code.
+func startTOTPLogin(ctx context.Context, username string) {
+	sessionManager.Put(ctx, "totp_user", username)
+	sessionManager.Put(ctx, "totp_deadline", time.Now().Add(totpLoginTimeout).Unix())
+}
+
+// pendingTOTPUser returns the user who must enter a code to log in, or "" if
+// there's none or they took too long.
+func pendingTOTPUser(ctx context.Context) string {
+	if time.Now().Unix() > sessionManager.GetInt64(ctx, "totp_deadline") {
+		return ""
+	}
+	return sessionManager.GetString(ctx, "totp_user")
+}
+
+func endTOTPLogin(ctx context.Context) {
+	sessionManager.Remove(ctx, "totp_user")
+	sessionManager.Remove(ctx, "totp_deadline")
+}
+
+// loginTOTPPage handles GET /login/totp, the second step of logging in.
+func (a App) loginTOTPPage(w http.ResponseWriter, r *http.Request) {
+	if pendingTOTPUser(r.Context()) == "" {
+		sendTo(w, "/login")
+		return
+	}
+	a.renderLoginPage(w, r, "GET /login/totp", http.StatusOK, map[string]any{"TOTPStep": true})
+}
+
+// loginTOTPAction handles POST /login/totp, logging in the user who entered
+// their password if the code is right.
+func (a App) loginTOTPAction(w http.ResponseWriter, r *http.Request) {
+	username := pendingTOTPUser(r.Context())
+	if username == "" {
+		endTOTPLogin(r.Context())
+		sendTo(w, "/login")
+		return
+	}
+	err := a.checkSecondFactor(r, username, r.PostFormValue("code"))
+	var tooMany *tooManyLoginsError
+	if errors.As(err, &tooMany) {
+		a.Logger.Error("POST /login/totp: authenticating user %q: %v", username, err)
+		w.Header().Set("Retry-After", retryAfter(tooMany))
+		a.renderLoginPage(w, r, "POST /login/totp", http.StatusTooManyRequests, map[string]any{"TOTPStep": true, "TooManyLogins": true})
+		return
+	} else if errors.Is(err, models.ErrInvalidCredentials) {
+		a.Logger.Error("POST /login/totp: authenticating user %q: %v", username, err)
+		a.renderLoginPage(w, r, "POST /login/totp", http.StatusOK, map[string]any{"TOTPStep": true, "BadCode": true})
+		return
+	} else if err != nil {
+		a.Logger.Error("POST /login/totp: authenticating user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+
+	endTOTPLogin(r.Context())
+	if err := a.logIn(r, username); err != nil {
+		a.Logger.Error("POST /login/totp: %v", err)
+		internalServerError(w)
+		return
+	}
+	sendTo(w, "/")
+}
+
+// checkSecondFactor checks a TOTP or recovery code of a user, with the same
+// limits as passwords.
+func (a App) checkSecondFactor(r *http.Request, username, code string) error {
+	done, wait := a.logins.attempt(clientIP(r), username)
+	if wait > 0 {
+		return &tooManyLoginsError{wait}
+	}
+	err := a.useSecondFactor(username, code)
+	done(errors.Is(err, models.ErrInvalidCredentials))
+	return err
+}
+
+// useSecondFactor uses up a TOTP or recovery code of a user if it's valid.
+func (a App) useSecondFactor(username, code string) error {
+	secret, lastStep, err := a.users.TOTP(username)
+	if err != nil {
+		return err
+	}
+	var step int64
+	if secret != "" {
+		if step, err = totp.Validate(secret, code, time.Now(), lastStep); err != nil {
+			return err
+		}
+	}
+	if step != 0 {
+		return a.users.UseTOTPStep(username, step)
+	}
+	return a.users.UseRecoveryCode(username, code)
+}
+
+// totpPage handles GET /2fa, where users enable or disable TOTP.
+func (a App) totpPage(w http.ResponseWriter, r *http.Request) {
+	a.renderTOTPPage(w, r, "GET /2fa", nil)
+}
+
+// enableTOTPAction handles POST /2fa/enable, enabling TOTP once the user has
+// entered a code generated with the secret they were given.
+func (a App) enableTOTPAction(w http.ResponseWriter, r *http.Request) {
+	username := sessionManager.GetString(r.Context(), "user")
+	secret := sessionManager.GetString(r.Context(), "totp_new_secret")
+	if secret == "" {
+		sendTo(w, "/2fa")
+		return
+	}
+	step, err := totp.Validate(secret, r.PostFormValue("code"), time.Now(), 0)
+	if err != nil {
+		a.Logger.Error("POST /2fa/enable: %v", err)
+		internalServerError(w)
+		return
+	}
+	if step == 0 {
+		a.renderTOTPPage(w, r, "POST /2fa/enable", map[string]any{"BadCode": true})
+		return
+	}
+	codes, err := a.users.EnableTOTP(username, secret, step)
+	if err != nil {
+		a.Logger.Error("POST /2fa/enable: enabling TOTP for user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+	sessionManager.Remove(r.Context(), "totp_new_secret")
+	a.Logger.Info("User %q enabled TOTP.", username)
+	a.renderTOTPPage(w, r, "POST /2fa/enable", map[string]any{"RecoveryCodes": codes})
+}
+
+// disableTOTPAction handles POST /2fa/disable.
+func (a App) disableTOTPAction(w http.ResponseWriter, r *http.Request) {
+	username := sessionManager.GetString(r.Context(), "user")
+	if !a.confirmSecondFactor(w, r, "POST /2fa/disable", username) {
+		return
+	}
+	if err := a.users.DisableTOTP(username); err != nil {
+		a.Logger.Error("POST /2fa/disable: disabling TOTP for user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+	a.Logger.Info("User %q disabled TOTP.", username)
+	sendTo(w, "/2fa")
+}
+
+// newRecoveryCodesAction handles POST /2fa/recovery-codes, which replaces
+// the recovery codes of the user.
+func (a App) newRecoveryCodesAction(w http.ResponseWriter, r *http.Request) {
+	username := sessionManager.GetString(r.Context(), "user")
+	if !a.confirmSecondFactor(w, r, "POST /2fa/recovery-codes", username) {
+		return
+	}
+	codes, err := a.users.NewRecoveryCodes(username)
+	if err != nil {
+		a.Logger.Error("POST /2fa/recovery-codes: generating recovery codes for user %q: %v", username, err)
+		internalServerError(w)
+		return
+	}
+	a.renderTOTPPage(w, r, "POST /2fa/recovery-codes", map[string]any{"RecoveryCodes": codes})
+}
+
+// confirmSecondFactor checks the code sent by a logged in user to confirm
+// changing their second factor. If it's wrong, it renders the error and
+// returns false.
+func (a App) confirmSecondFactor(w http.ResponseWriter, r *http.Request, route, username string) bool {
+	err := a.checkSecondFactor(r, username, r.PostFormValue("code"))
+	var tooMany *tooManyLoginsError
+	if errors.As(err, &tooMany) {
+		a.Logger.Warn("%s: user %q: %v", route, username, err)
+		tooManyLogins(w, tooMany)
+		return false
+	} else if errors.Is(err, models.ErrInvalidCredentials) {
+		a.renderTOTPPage(w, r, route, map[string]any{"BadCode": true})
+		return false
+	} else if err != nil {
+		a.Logger.Error("%s: checking code of user %q: %v", route, username, err)
+		internalServerError(w)
+		return false
+	}
+	return true
+}
+
+// renderTOTPPage renders the TOTP settings of the user, with the given data.
+// Users who haven't enabled TOTP are given a new secret to enable it with,
+// kept in their session until they do.
+func (a App) renderTOTPPage(w http.ResponseWriter, r *http.Request, route string, data map[string]any) {
+	tmpl, err := template.ParseFS(templatesFS, "templates/base.tmpl", "templates/totp.tmpl")
+	if err != nil {
+		a.Logger.Error("%s: parsing template: %v", route, err)
+		internalServerError(w)
+		return
+	}
+	username := sessionManager.GetString(r.Context(), "user")
+	secret, _, err := a.users.TOTP(username)
+	if err != nil {
+		a.Logger.Error("%s: getting TOTP secret of user %q: %v", route, username, err)
+		internalServerError(w)
+		return
+	}
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["Authenticated"] = sessionManager.GetBool(r.Context(), "authenticated")
+	data["User"] = username
+	data["CSRFToken"] = csrfToken(r.Context())
+	data["Admin"] = isAdminSession(r.Context())
+	data["Enabled"] = secret != ""
+
+	if secret != "" {
+		left, err := a.users.RecoveryCodesLeft(username)
+		if err != nil {
+			a.Logger.Error("%s: counting recovery codes of user %q: %v", route, username, err)
+			internalServerError(w)
+			return
+		}
+		data["RecoveryCodesLeft"] = left
+	} else {
+		newSecret := sessionManager.GetString(r.Context(), "totp_new_secret")
+		if newSecret == "" {
+			if newSecret, err = totp.NewSecret(); err != nil {
+				a.Logger.Error("%s: %v", route, err)
+				internalServerError(w)
+				return
+			}
+			sessionManager.Put(r.Context(), "totp_new_secret", newSecret)
+		}
+		png, err := qrcode.Encode(totp.URI(newSecret, "Hermes", username+"@"+cfg.HTTP.DomainName), qrcode.Medium, 256)
+		if err != nil {
+			a.Logger.Error("%s: encoding QR code: %v", route, err)
+			internalServerError(w)
+			return
+		}
+		data["NewSecret"] = newSecret
+		data["QRCode"] = base64.StdEncoding.EncodeToString(png)
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		a.Logger.Error("%s: executing template: %v", route, err)
+		internalServerError(w)
+		return
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// Resumable uploads, through version 1.0.0 of the tus protocol with the
+// creation, termination and expiration extensions. Partial uploads are
+// kept under the tus directory of storage.uploaded_files_dir, whatever the
+// storage backend is, and become regular uploaded files once complete.
+//
+// See: https://tus.io/protocols/resumable-upload
+
+const tusVersion = "1.0.0"
+
+// tusExpiry is how long a tus upload may take to complete. Completed
+// uploads are remembered for as long, so that clients can check that they
+// went through.
+const tusExpiry = 24 * time.Hour
+
+// tusLocks holds the IDs of the tus uploads being written to, so that only
+// one request at a time can append to them.
+var tusLocks = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+func lockTusUpload(id string) bool {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+	if tusLocks.ids[id] {
+		return false
+	}
+	tusLocks.ids[id] = true
+	return true
+}
+
+func unlockTusUpload(id string) {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+	delete(tusLocks.ids, id)
+}
+
+// tusPath returns the path of the file holding the data of a tus upload.
+func tusPath(id string) string {
+	return filepath.Join(cfg.Storage.UploadedFilesDir, "tus", id)
+}
+
+func (a App) tusRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(requireTusResumable)
+	r.Options("/", tusOptions)
+	r.Options("/{id}", tusOptions)
+	r.Group(func(r chi.Router) {
+		r.Use(requireTokenLogin, requireScope(models.ScopeUpload), a.requireRole(models.RoleUploader), a.verifyCSRF)
+		r.Post("/", a.tusCreate)
+		r.Head("/{id}", a.tusHead)
+		r.Patch("/{id}", a.tusPatch)
+		r.Delete("/{id}", a.tusDelete)
+	})
+	return r
+}
+
+// requireTusResumable rejects requests made with versions of the protocol
+// other than the one we support.
+func requireTusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.Storage.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusCreate handles POST /tus/. The metadata of the upload may have the
+// "filename", "title", "expires", "burn_after_reading" and "visibility" keys,
+// which work like the fields of POST /api/v1/files.
+func (a App) tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > cfg.Storage.MaxUploadSize {
+		uploadTooLarge(w, r)
+		return
+	}
+	u := &models.TusUpload{
+		Uploader: currentUser(r),
+		Length:   length,
+		Metadata: r.Header.Get("Upload-Metadata"),
+		Expires:  time.Now().Add(tusExpiry).UTC().Truncate(time.Second),
+	}
+	if _, err := tusFile(u); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	u.ID, err = randomIdentifier(32)
+	if err != nil {
+		a.Logger.Error("POST /tus: %v", err)
+		internalServerError(w)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(tusPath(u.ID)), 0o755); err != nil {
+		a.Logger.Error("POST /tus: %v", err)
+		internalServerError(w)
+		return
+	}
+	f, err := os.OpenFile(tusPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		a.Logger.Error("POST /tus: %v", err)
+		internalServerError(w)
+		return
+	}
+	f.Close()
+	if err := a.tusUploads.Insert(u); err != nil {
+		os.Remove(tusPath(u.ID))
+		a.Logger.Error("POST /tus: inserting tus upload: %v", err)
+		internalServerError(w)
+		return
+	}
+	if length == 0 {
+		if err := a.completeTusUpload(r.Context(), u); err != nil {
+			a.Logger.Error("POST /tus: %v", err)
+			uploadError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", absoluteURL("/tus/"+u.ID))
+	setTusUploadHeaders(w, u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a App) tusHead(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.tusUploadFromURL(w, r)
+	if !ok {
+		return
+	}
+	offset, err := tusOffset(u)
+	if err != nil {
+		a.Logger.Error("HEAD /tus/%s: %v", u.ID, err)
+		internalServerError(w)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	setTusUploadHeaders(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a App) tusPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if !lockTusUpload(id) {
+		http.Error(w, "Upload is being written to by another request", http.StatusLocked)
+		return
+	}
+	defer unlockTusUpload(id)
+
+	u, ok := a.tusUploadFromURL(w, r)
+	if !ok {
+		return
+	}
+	current, err := tusOffset(u)
+	if err != nil {
+		a.Logger.Error("PATCH /tus/%s: %v", u.ID, err)
+		internalServerError(w)
+		return
+	}
+	if offset != current {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		http.Error(w, "Upload-Offset doesn't match the upload", http.StatusConflict)
+		return
+	}
+	if r.ContentLength > u.Length-offset {
+		http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if u.Slug == "" {
+		start := offset
+		f, err := os.OpenFile(tusPath(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			a.Logger.Error("PATCH /tus/%s: %v", u.ID, err)
+			internalServerError(w)
+			return
+		}
+		n, err := io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		offset += n
+		if err != nil {
+			// Most likely the client went away; it may resume from
+			// what was written.
+			a.Logger.Warn("PATCH /tus/%s: interrupted at offset %d: %v", u.ID, offset, err)
+			internalServerError(w)
+			return
+		}
+		if offset == u.Length {
+			if err := a.completeTusUpload(r.Context(), u); err != nil {
+				a.Logger.Error("PATCH /tus/%s: %v", u.ID, err)
+				a.failTusUpload(u, start, err)
+				uploadError(w, r, err)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	setTusUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDelete terminates a tus upload. Once the upload is complete, this only
+// forgets about it; the uploaded file is left alone.
+func (a App) tusDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !lockTusUpload(id) {
+		http.Error(w, "Upload is being written to by another request", http.StatusLocked)
+		return
+	}
+	defer unlockTusUpload(id)
+
+	u, ok := a.tusUploadFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := a.tusUploads.Delete(u.ID); err != nil {
+		a.Logger.Error("DELETE /tus/%s: %v", u.ID, err)
+		internalServerError(w)
+		return
+	}
+	if err := os.Remove(tusPath(u.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		a.Logger.Error("DELETE /tus/%s: %v", u.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusUploadFromURL gets the tus upload of the current user whose ID is in
+// the URL. If it fails, it writes the error response and returns false.
+func (a App) tusUploadFromURL(w http.ResponseWriter, r *http.Request) (*models.TusUpload, bool) {
+	u, err := a.tusUploads.Get(chi.URLParam(r, "id"))
+	if errors.Is(err, models.ErrNoRecord) || err == nil && u.Uploader != currentUser(r) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		a.Logger.Error("%s /tus: getting tus upload: %v", r.Method, err)
+		internalServerError(w)
+		return nil, false
+	}
+	return u, true
+}
+
+// tusOffset returns how many bytes of a tus upload were received.
+func tusOffset(u *models.TusUpload) (int64, error) {
+	if u.Slug != "" {
+		return u.Length, nil
+	}
+	info, err := os.Stat(tusPath(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func setTusUploadHeaders(w http.ResponseWriter, u *models.TusUpload) {
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	if u.Slug != "" {
+		// Not part of the protocol: lets clients know where the
+		// uploaded file is.
+		f, _ := tusFile(u)
+		w.Header().Set("Content-Location", absoluteURL(f.FileHref()))
+	}
+}
+
+// completeTusUpload turns a tus upload whose data was fully received into
+// an uploaded file.
+func (a App) completeTusUpload(ctx context.Context, u *models.TusUpload) error {
+	f, err := tusFile(u)
+	if err != nil {
+		return err
+	}
+	data, err := os.Open(tusPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	if err := a.saveUpload(ctx, f, data, u.Length); err != nil {
+		return err
+	}
+	if err := a.tusUploads.Complete(u.ID, f.Slug); err != nil {
+		return fmt.Errorf("completing tus upload: %v", err)
+	}
+	u.Slug = f.Slug
+	if err := os.Remove(tusPath(u.ID)); err != nil {
+		a.Logger.Error("removing data of tus upload %s: %v", u.ID, err)
+	}
+	return nil
+}
+
+// failTusUpload handles a tus upload that couldn't be completed with err.
+// If the upload itself is at fault, e.g. its contents don't match its
+// filename, it's terminated. Otherwise, the data from start on, sent by the
+// last PATCH request, is dropped, so that the client resumes by sending it
+// again, which retries the completion.
+func (a App) failTusUpload(u *models.TusUpload, start int64, err error) {
+	if uploadErrorStatus(err) == http.StatusInternalServerError {
+		if err := os.Truncate(tusPath(u.ID), start); err != nil {
+			a.Logger.Error("rolling back tus upload %s to offset %d: %v", u.ID, start, err)
+		}
+		return
+	}
+	if err := a.tusUploads.Delete(u.ID); err != nil {
+		a.Logger.Error("deleting failed tus upload %s: %v", u.ID, err)
+	}
+	if err := os.Remove(tusPath(u.ID)); err != nil {
+		a.Logger.Error("removing data of tus upload %s: %v", u.ID, err)
+	}
+}
+
+// tusFile returns the uploaded file that a tus upload becomes, as described
+// by its metadata. The slug is only filled in if the upload is complete.
+func tusFile(u *models.TusUpload) (*models.UploadedFile, error) {
+	metadata, err := parseTusMetadata(u.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	filename, err := sanitizeFilename(metadata["filename"])
+	if err != nil {
+		return nil, err
+	}
+	expires, err := parseExpiry(metadata["expires"])
+	if err != nil {
+		return nil, err
+	}
+	visibility, err := parseVisibility(metadata["visibility"])
+	if err != nil {
+		return nil, err
+	}
+	burn, _ := strconv.ParseBool(metadata["burn_after_reading"])
+
+	title := metadata["title"]
+	if title == "" {
+		title = filename
+	}
+	return &models.UploadedFile{
+		Slug:             u.Slug,
+		Title:            title,
+		Uploader:         u.Uploader,
+		Filename:         filename,
+		Expires:          expires,
+		BurnAfterReading: burn,
+		Visibility:       visibility,
+	}, nil
+}
+
+// parseTusMetadata parses an Upload-Metadata header: comma-separated pairs
+// of a key and its base64-encoded value, separated by a space.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("value of %q: %v", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// deleteExpiredTusUploads deletes the tus uploads that weren't completed in
+// time, along with their data. Uploads being written to are left for next
+// time, rather than having their data removed under the request.
+func (a App) deleteExpiredTusUploads() error {
+	ids, err := a.tusUploads.Expired()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !lockTusUpload(id) {
+			continue
+		}
+		err := a.deleteTusUpload(id)
+		unlockTusUpload(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTusUpload deletes an expired tus upload, which must be locked, along
+// with its data.
+func (a App) deleteTusUpload(id string) error {
+	if err := a.tusUploads.Delete(id); errors.Is(err, models.ErrNoRecord) {
+		// Deleted by its uploader meanwhile.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(tusPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		a.Logger.Error("removing data of tus upload %s: %v", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errBadUpload is wrapped by the errors caused by malformed upload requests.
+var errBadUpload = errors.New("malformed upload")
+
+// maxFormFieldSize is the maximum size of the fields of an upload form other
+// than the file itself.
+const maxFormFieldSize = 64 << 10 // 64 KiB
+
+// uploadForm is a multipart upload form, read by readUploadForm.
+type uploadForm struct {
+	Values url.Values
+	// Filename is the sanitized name of the uploaded file.
+	Filename string
+
+	blob *stagedBlob
+}
+
+// readUploadForm reads a multipart/form-data request, streaming the file sent
+// in the fileField part straight to storage instead of buffering it. The
+// other parts are read as form values. The file is staged until the caller
+// commits or discards form.blob.
+func (a App) readUploadForm(r *http.Request, fileField string) (form *uploadForm, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadUpload, err)
+	}
+
+	form = &uploadForm{Values: url.Values{}}
+	defer func() {
+		if err != nil && form.blob != nil {
+			a.discardBlob(r.Context(), form.blob)
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return form, fmt.Errorf("%w: reading multipart form: %w", errBadUpload, err)
+		}
+
+		if part.FormName() == fileField {
+			if form.blob != nil {
+				return form, fmt.Errorf("%w: more than one %q part", errBadUpload, fileField)
+			}
+			form.Filename, err = sanitizeFilename(part.FileName())
+			if err != nil {
+				return form, fmt.Errorf("%w: %v", errBadUpload, err)
+			}
+			form.blob, err = a.stageBlob(r.Context(), part, -1)
+			if err != nil {
+				return form, err
+			}
+			continue
+		}
+
+		var value strings.Builder
+		n, err := io.Copy(&value, io.LimitReader(part, maxFormFieldSize+1))
+		if err != nil {
+			return form, fmt.Errorf("%w: reading multipart form: %w", errBadUpload, err)
+		}
+		if n > maxFormFieldSize {
+			return form, fmt.Errorf("%w: field %q is too large", errBadUpload, part.FormName())
+		}
+		form.Values.Add(part.FormName(), value.String())
+	}
+	if form.blob == nil {
+		return form, fmt.Errorf("%w: missing %q part", errBadUpload, fileField)
+	}
+	return form, nil
+}
+
+// limitUploadSize rejects request bodies larger than the maximum upload size.
+func limitUploadSize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > cfg.Storage.MaxUploadSize {
+			uploadTooLarge(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.Storage.MaxUploadSize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// uploadErrorStatus returns the status code of the response to an upload
+// that failed with err.
+func uploadErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errBadUpload):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// uploadError returns the error response to an upload that failed with err.
+func uploadError(w http.ResponseWriter, r *http.Request, err error) {
+	switch uploadErrorStatus(err) {
+	case http.StatusRequestEntityTooLarge:
+		uploadTooLarge(w, r)
+	case http.StatusBadRequest:
+		if isAPIRequest(r) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("Invalid upload: %v.", err))
+		} else {
+			http.Error(w, "Invalid upload", http.StatusBadRequest)
+		}
+	default:
+		if isAPIRequest(r) {
+			apiInternalServerError(w)
+		} else {
+			internalServerError(w)
+		}
+	}
+}
+
+func uploadTooLarge(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("Upload too large (max. %d bytes)", cfg.Storage.MaxUploadSize)
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", message+".")
+	} else {
+		http.Error(w, message, http.StatusRequestEntityTooLarge)
+	}
+}
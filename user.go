@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+const userUsage = `usage: hermes user <command> [arguments]
+
+Commands:
+  add [-role <role>] <username>
+                       create a new user, with the uploader role by default
+  passwd <username>    change the password of a user, logging them out
+  role <username> <role>
+                       change the role of a user, logging them out
+  delete <username>    delete a user, logging them out
+  disable-2fa <username>
+                       disable the two-factor authentication of a user who
+                       lost both their authenticator app and recovery codes
+  list                 list all users, with their roles, and whether
+                       they're disabled
+
+Roles are viewer (may log in, but not upload), uploader (may upload, and
+delete their own uploads) and admin (may also delete the uploads of others,
+and manage users).
+
+Passwords are prompted for on the terminal, or read from the first line of
+standard input when it isn't a terminal.
+`
+
+// userCommand runs the "hermes user" subcommands.
+func userCommand(users *models.UserModel, sessions *models.SessionModel, args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "add":
+		flags := flag.NewFlagSet("hermes user add", flag.ContinueOnError)
+		role := flags.String("role", models.RoleUploader, "role of the user")
+		if err := flags.Parse(args); err != nil {
+			return errors.New("usage: hermes user add [-role <role>] <username>")
+		}
+		username, err := usernameArg(cmd, flags.Args())
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(models.Roles, *role) {
+			return fmt.Errorf("invalid role %q, must be one of %s", *role, strings.Join(models.Roles, ", "))
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if _, err := users.Insert(username, password, *role); err != nil {
+			return fmt.Errorf("adding user %q: %v", username, err)
+		}
+		fmt.Printf("User %q created with the %s role.\n", username, *role)
+	case "passwd":
+		username, err := usernameArg(cmd, args)
+		if err != nil {
+			return err
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if err := users.SetPassword(username, password); err != nil {
+			return fmt.Errorf("changing password of user %q: %v", username, err)
+		}
+		if err := logOutEverywhere(sessions, username); err != nil {
+			return err
+		}
+		fmt.Printf("Password of user %q changed.\n", username)
+	case "role":
+		if len(args) != 2 || strings.TrimSpace(args[0]) == "" {
+			return errors.New("usage: hermes user role <username> <role>")
+		}
+		username, role := args[0], args[1]
+		if !slices.Contains(models.Roles, role) {
+			return fmt.Errorf("invalid role %q, must be one of %s", role, strings.Join(models.Roles, ", "))
+		}
+		if err := users.SetRole(username, role); err != nil {
+			return fmt.Errorf("changing role of user %q: %v", username, err)
+		}
+		// Sessions carry the role their user had when logging in.
+		if err := logOutEverywhere(sessions, username); err != nil {
+			return err
+		}
+		fmt.Printf("User %q now has the %s role.\n", username, role)
+	case "delete":
+		username, err := usernameArg(cmd, args)
+		if err != nil {
+			return err
+		}
+		if err := users.Delete(username); err != nil {
+			return fmt.Errorf("deleting user %q: %v", username, err)
+		}
+		if err := logOutEverywhere(sessions, username); err != nil {
+			return err
+		}
+		fmt.Printf("User %q deleted.\n", username)
+	case "disable-2fa":
+		username, err := usernameArg(cmd, args)
+		if err != nil {
+			return err
+		}
+		if err := users.DisableTOTP(username); err != nil {
+			return fmt.Errorf("disabling two-factor authentication of user %q: %v", username, err)
+		}
+		fmt.Printf("Two-factor authentication of user %q disabled.\n", username)
+	case "list":
+		if len(args) != 0 {
+			return errors.New("usage: hermes user list")
+		}
+		list, err := users.List()
+		if err != nil {
+			return fmt.Errorf("listing users: %v", err)
+		}
+		for _, u := range list {
+			if u.Disabled {
+				fmt.Printf("%s\t%s\tdisabled\n", u.Username, u.Role)
+			} else {
+				fmt.Printf("%s\t%s\n", u.Username, u.Role)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", cmd, userUsage)
+	}
+	return nil
+}
+
+// logOutEverywhere revokes every session of a user.
+func logOutEverywhere(sessions *models.SessionModel, username string) error {
+	_, err := revokeSessions(sessions, username, func(string) bool { return true })
+	if err != nil {
+		return fmt.Errorf("logging out user %q: %v", username, err)
+	}
+	return nil
+}
+
+func usernameArg(cmd string, args []string) (string, error) {
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		return "", fmt.Errorf("usage: hermes user %s <username>", cmd)
+	}
+	return args[0], nil
+}
+
+// readNewPassword reads a password, asking for confirmation when standard
+// input is a terminal.
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("reading password: %v", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", errors.New("password must not be empty")
+		}
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("reading password: %v", err)
+	}
+	if len(password) == 0 {
+		return "", errors.New("password must not be empty")
+	}
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirmation, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("reading password: %v", err)
+	}
+	if string(password) != string(confirmation) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
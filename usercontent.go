@@ -0,0 +1,94 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// userContentCSP is the Content-Security-Policy of raw files. It lets
+// browsers show images and play media, but sandboxes anything else, so that
+// scripts in uploaded files can't run.
+const userContentCSP = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// isPassiveContent reports whether files of a media type can be shown
+// inline by browsers without running anything. Other files, e.g. HTML pages
+// and SVG images, are only served as downloads.
+func isPassiveContent(mimeType string) bool {
+	typ, subtype := splitMIMEType(mimeType)
+	if subtype == "xml" || strings.HasSuffix(subtype, "+xml") {
+		return false
+	}
+	switch typ {
+	case "image", "audio", "video":
+		return true
+	case "text":
+		switch subtype {
+		case "html", "javascript", "ecmascript":
+			return false
+		}
+		return true
+	case "application":
+		return subtype == "json"
+	}
+	return false
+}
+
+// setUserContentHeaders sets the headers raw files are served with: their
+// media type, whether they're shown inline or downloaded, and the policy
+// keeping browsers from running them.
+func setUserContentHeaders(w http.ResponseWriter, f *models.UploadedFile) {
+	disposition := "attachment"
+	if isPassiveContent(f.MIMEType) {
+		disposition = "inline"
+	}
+	mimeType := f.MIMEType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("Content-Type", mimeType)
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": f.Filename}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", userContentCSP)
+}
+
+// rawFileURL returns the URL a file is downloaded from, which is on the
+// user content domain if one is configured. The URLs of private files are
+// signed, and expire.
+func rawFileURL(f *models.UploadedFile) string {
+	href := f.RawFileHref()
+	if f.Visibility == models.VisibilityPrivate {
+		href += "?" + signRawURL(f, time.Now().Add(rawURLLifetime)).Encode()
+	}
+	if cfg.HTTP.UserContentDomain == "" {
+		return absoluteURL(href)
+	}
+	return cfg.HTTP.Schema + "://" + cfg.HTTP.UserContentDomain + href
+}
+
+// separateUserContent serves raw files only from the user content domain,
+// if one is configured, so that they don't share an origin with hermes and
+// its session cookie. Raw file requests to the hermes domain are redirected,
+// and other requests to the user content domain aren't served.
+func (a App) separateUserContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := cfg.HTTP.UserContentDomain
+		if domain == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		isRawFile := strings.HasPrefix(r.URL.Path, "/dl/")
+		switch {
+		case r.Host == domain && !isRawFile:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		case r.Host != domain && isRawFile:
+			http.Redirect(w, r, cfg.HTTP.Schema+"://"+domain+r.URL.RequestURI(), http.StatusFound)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
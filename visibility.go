@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tsilvap/hermes/internal/models"
+)
+
+// Private files can only be seen by their uploader. Their raw file URLs are
+// signed, since the user content domain doesn't get the session cookie: a
+// signed URL lets anyone who has it download the file, until it expires.
+// The signing key is made anew each time hermes starts, which also expires
+// the URLs.
+
+// rawURLLifetime is how long signed raw file URLs are valid for.
+const rawURLLifetime = time.Hour
+
+var rawURLKey = newRawURLKey()
+
+func newRawURLKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generating key of raw file URLs: %v", err))
+	}
+	return key
+}
+
+// parseVisibility returns the visibility chosen for an upload, which is
+// public if none is.
+func parseVisibility(choice string) (string, error) {
+	if choice == "" {
+		return models.VisibilityPublic, nil
+	}
+	if !slices.Contains(models.Visibilities, choice) {
+		return "", fmt.Errorf("invalid visibility %q", choice)
+	}
+	return choice, nil
+}
+
+// canView reports whether the user making the request may see an upload.
+// Private uploads can be seen by their uploader, or with a signed raw file
+// URL.
+func canView(r *http.Request, f *models.UploadedFile) bool {
+	if f.Visibility != models.VisibilityPrivate {
+		return true
+	}
+	if user := currentUser(r); user != "" && user == f.Uploader {
+		return true
+	}
+	return validRawURLSignature(r.URL.Query(), f, time.Now())
+}
+
+// signRawURL returns the query parameters that let a private file be
+// downloaded until expires.
+func signRawURL(f *models.UploadedFile, expires time.Time) url.Values {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"expires": {exp},
+		"sig":     {rawURLSignature(f.Slug, exp)},
+	}
+}
+
+// validRawURLSignature reports whether query has a signature of the raw
+// file URL of f which hasn't expired by now.
+func validRawURLSignature(query url.Values, f *models.UploadedFile, now time.Time) bool {
+	exp, sig := query.Get("expires"), query.Get("sig")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(rawURLSignature(f.Slug, exp)))
+}
+
+func rawURLSignature(slug, expires string) string {
+	mac := hmac.New(sha256.New, rawURLKey)
+	mac.Write([]byte(slug + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}